@@ -1,36 +1,358 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/big"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/pressly/goose/v3"
+	"golang.org/x/text/unicode/norm"
 )
 
 // struct based on books.json file. Please refer
 type Book struct {
-	Id       string `json:"id"`
-	Title    string `json:"title"`
-	Author   string `json:"author"`
-	Price    string `json:"price"`
-	Imageurl string `json:"image_url"`
+	Id       string `json:"id" validate:"required"`
+	Title    string `json:"title" validate:"required"`
+	Author   string `json:"author" validate:"required"`
+	Price    Money  `json:"price" validate:"required"`
+	Imageurl string `json:"image_url" validate:"omitempty,httpurl"`
+	// set only by PUT /books/{id}/cover
+	Cover   *Cover `json:"cover,omitempty"`
+	Version int64  `json:"version"`
+	// set when the book is in trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// uploaded cover image of a book, URL is the path it is served from
+type Cover struct {
+	URL             string `json:"url"`
+	ContentType     string `json:"content_type"`
+	Size            int64  `json:"size"`
+	Width           int    `json:"width"`
+	Height          int    `json:"height"`
+	ThumbnailWidth  int    `json:"thumbnail_width"`
+	ThumbnailHeight int    `json:"thumbnail_height"`
+}
+
+// price of a book
+// Amount is kept in minor units (paise, cents), so prices can be compared and summed exactly
+// amounts of different currencies are never compared
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+// currency of prices stored as plain strings in old books.json files
+const DEFAULT_CURRENCY string = "INR"
+
+// ISO 4217 currencies without two minor digits, all the others have two
+var CURRENCY_DIGITS = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
 }
 
+// how long deleted books stay in trash before the purge job removes them
+const TRASH_RETENTION time.Duration = 30 * 24 * time.Hour
+
 // define port
 const PORT string = ":8080"
 
+// timeouts of the server
+const (
+	READ_TIMEOUT     time.Duration = 15 * time.Second
+	WRITE_TIMEOUT    time.Duration = 30 * time.Second
+	IDLE_TIMEOUT     time.Duration = 2 * time.Minute
+	SHUTDOWN_TIMEOUT time.Duration = 30 * time.Second
+	PURGE_INTERVAL   time.Duration = time.Hour
+)
+
+// content types of PATCH /books/{id}
+const (
+	MERGE_PATCH string = "application/merge-patch+json"
+	JSON_PATCH  string = "application/json-patch+json"
+)
+
+// default location of the books catalog
+const BOOKS_FILE string = "./books.json"
+
+// default location of the audit log, one json change per line
+const AUDIT_FILE string = "./audit.jsonl"
+
+// default directory of the uploaded covers
+const COVERS_DIR string = "./covers"
+
+// limits of the cover images
+const (
+	MAX_COVER_SIZE int64 = 5 << 20
+	// thumbnails fit into a square of this size
+	THUMBNAIL_SIZE int = 256
+)
+
+// page size of book listing
+const (
+	DEFAULT_LIMIT int = 20
+	MAX_LIMIT     int = 100
+)
+
 // message to send as json response
+// Msg is kept for old clients, Error is set for failed requests
 type Message struct {
-	Msg string
+	Msg   string    `json:"Msg"`
+	Error *APIError `json:"error,omitempty"`
+}
+
+// page of books returned by GET /books
+type BookPage struct {
+	Books  []Book `json:"books"`
+	Total  int    `json:"total"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+}
+
+// options of book listing taken from the query string
+type ListOptions struct {
+	Limit    int
+	Offset   int
+	Author   string
+	Title    string
+	Currency string
+	MinPrice *int64
+	MaxPrice *int64
+	Sort     string
+	Desc     bool
+}
+
+// structured error sent to the client
+type APIError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+// validation error of a single field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// failed row of a catalog import, rows are numbered from 1 like lines of the file
+type ImportError struct {
+	Row     int          `json:"row"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+// result of a catalog import
+type ImportResult struct {
+	Created int           `json:"created"`
+	Updated int           `json:"updated"`
+	Failed  int           `json:"failed"`
+	Errors  []ImportError `json:"errors"`
+}
+
+// book read from a row of the imported file, Errors is set when the row is invalid
+type importRow struct {
+	Row    int
+	Book   Book
+	Errors []FieldError
+}
+
+// error codes used in APIError
+const (
+	CodeBadRequest       string = "bad_request"
+	CodeUnauthorized     string = "unauthorized"
+	CodeValidationFailed string = "validation_failed"
+	CodeNotFound         string = "not_found"
+	CodeConflict         string = "conflict"
+	CodePrecondition     string = "precondition_failed"
+	CodeMethodNotAllowed string = "method_not_allowed"
+	CodeUnsupportedMedia string = "unsupported_media_type"
+	CodeTooLarge         string = "payload_too_large"
+	CodeInternalError    string = "internal_error"
+	CodeUnavailable      string = "service_unavailable"
+)
+
+// returned by the store when requested book does not exist
+var ErrBookNotFound = errors.New("book not found")
+
+// returned by the store when book with the same id already exists
+var ErrBookExists = errors.New("book already exists")
+
+// returned by the store when expected version of the book is not the stored one
+var ErrVersionMismatch = errors.New("book version mismatch")
+
+// returned when price in the request or books file can not be parsed
+var ErrInvalidPrice = errors.New("invalid price")
+
+// returned when patch document is malformed
+var ErrInvalidPatch = errors.New("invalid patch")
+
+// returned when test operation of a JSON Patch does not match
+var ErrPatchTestFailed = errors.New("patch test failed")
+
+// returned when patch is valid but can not be applied to the book
+var ErrPatchNotApplicable = errors.New("patch can not be applied")
+
+// returned when books file can not be parsed, the file is left untouched
+var ErrCorruptCatalog = errors.New("corrupt books catalog")
+
+// error returned when the books file is already opened by another process
+var ErrCatalogLocked = errors.New("books file is used by another process")
+
+// returned by the cover store when the upload is not a supported image
+var ErrInvalidCover = errors.New("cover must be a JPEG, PNG or GIF image")
+
+// book written by the store, Before is nil when Upsert added the book
+type BookChange struct {
+	Before *Book
+	After  Book
+}
+
+// validator for the required fields of a book, reports json field names
+var validate = newValidator()
+
+// storage for the books catalog used by all the handlers
+// new books start at version 1 and every update increments it.
+// Update expects book.Version and Delete expects version to match the
+// stored one, 0 skips the check.
+// Delete moves the book to trash, List and Get do not see it until it is
+// restored, its id stays taken until Purge removes it for good
+// Upsert adds new books and replaces stored ones whatever their version,
+// all at once, it fails for books in trash
+// Update, Delete and Restore return the book as it was before and after
+// the change, Purge the removed books, all read in the same critical section as the write
+type BookStore interface {
+	List() ([]Book, error)
+	Get(id string) (Book, error)
+	Add(books ...Book) error
+	Upsert(books ...Book) ([]BookChange, error)
+	Update(book Book) (BookChange, error)
+	Delete(id string, version int64) (BookChange, error)
+	Trash() ([]Book, error)
+	Restore(id string) (BookChange, error)
+	Purge(deletedBefore time.Time) ([]Book, error)
 }
 
 // response as json format
 func jsonMessageByte(msg string) []byte {
-	errrMessage := Message{"bebra"}
+	errrMessage := Message{Msg: "bebra"}
+	byteContent, _ := json.Marshal(errrMessage)
+	return byteContent
+}
+
+// error response as json format
+func jsonErrorByte(code string, msg string, fields []FieldError) []byte {
+	errrMessage := Message{msg, &APIError{code, msg, fields}}
 	byteContent, _ := json.Marshal(errrMessage)
 	return byteContent
 }
 
+// send error response with given status code
+func writeError(w http.ResponseWriter, status int, code string, msg string, fields ...FieldError) {
+	w.WriteHeader(status)
+	w.Write(jsonErrorByte(code, msg, fields))
+}
+
+// send error response for a request body which can not be decoded
+// invalid price is reported as a field error, anything else as bad request
+func writeBodyError(w http.ResponseWriter, err error, msg string) {
+	if errors.Is(err, ErrInvalidPrice) {
+		writeError(w, 422, CodeValidationFailed, "Invalid book", FieldError{"price", err.Error()})
+	} else {
+		writeError(w, 400, CodeBadRequest, msg)
+	}
+}
+
+// send error response for errors returned by the store
+func writeStoreError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrBookNotFound) {
+		writeError(w, 404, CodeNotFound, "Book Not found")
+	} else if errors.Is(err, ErrBookExists) {
+		writeError(w, 409, CodeConflict, "Book already exists")
+	} else if errors.Is(err, ErrVersionMismatch) {
+		writeError(w, 412, CodePrecondition, "Book was modified by another request")
+	} else {
+		log.Printf("Server Error %v\n", err)
+		writeError(w, 500, CodeInternalError, "Internal server error")
+	}
+}
+
+// ETag of the book, changes with every update
+func bookETag(book Book) string {
+	return fmt.Sprintf("\"%d\"", book.Version)
+}
+
+// take expected version of the book from If-Match header
+// writes 412 and returns false when the header is not a strong ETag of a book,
+// If-Match never matches weak ETags (RFC 7232)
+func applyIfMatch(w http.ResponseWriter, r *http.Request, version *int64) bool {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" || ifMatch == "*" {
+		return true
+	}
+	if len(ifMatch) < 2 || ifMatch[0] != '"' || ifMatch[len(ifMatch)-1] != '"' {
+		writeError(w, 412, CodePrecondition, "If-Match does not match the book")
+		return false
+	}
+	expected, err := strconv.ParseInt(ifMatch[1:len(ifMatch)-1], 10, 64)
+	if err != nil || expected < 1 {
+		writeError(w, 412, CodePrecondition, "If-Match does not match the book")
+		return false
+	}
+	*version = expected
+	return true
+}
+
+// send book with its ETag
+func writeBook(w http.ResponseWriter, status int, book Book) {
+	bookByte, _ := json.Marshal(book)
+	w.Header().Set("ETag", bookETag(book))
+	w.WriteHeader(status)
+	w.Write(bookByte)
+}
+
 // print logs in console
 func checkError(err error) {
 	if err != nil {
@@ -39,197 +361,3909 @@ func checkError(err error) {
 
 }
 
+// create validator which names fields after their json tags
+func newValidator() *validator.Validate {
+	v := validator.New()
+	// zero Money counts as missing price
+	v.RegisterCustomTypeFunc(func(field reflect.Value) interface{} {
+		if price := field.Interface().(Money); price != (Money{}) {
+			return price.String()
+		}
+		return ""
+	}, Money{})
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		return strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+	})
+	v.RegisterValidation("httpurl", func(fl validator.FieldLevel) bool {
+		return isHTTPURL(fl.Field().String())
+	})
+	return v
+}
+
+// absolute http or https URL with a host
+func isHTTPURL(value string) bool {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	return scheme == "http" || scheme == "https"
+}
+
+// check required fields of the book
+// prefix is put in front of the field names, e.g. "[1]." for batches
+func validateBook(book Book, prefix string) []FieldError {
+	var fields []FieldError
+	err := validate.Struct(book)
+	if validationErrors, ok := err.(validator.ValidationErrors); ok {
+		for _, fieldErr := range validationErrors {
+			msg := fieldErr.Field() + " is " + fieldErr.Tag()
+			if fieldErr.Tag() == "httpurl" {
+				msg = fieldErr.Field() + " must be an absolute http or https URL"
+			}
+			fields = append(fields, FieldError{prefix + fieldErr.Field(), msg})
+		}
+	}
+	return fields
+}
+
 // List all the books handler
-func handleGetBooks(w http.ResponseWriter, r *http.Request) {
-	books, err := getBooks()
+func handleGetBooks(store BookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		books, err := store.List()
 
-	// send server error as response
-	if err != nil {
-		log.Printf("Server Error %v\n", err)
-		w.WriteHeader(500)
-		w.Write(jsonMessageByte("Internal server error"))
-	} else {
-		booksByte, _ := json.Marshal(books)
-		w.Write(booksByte)
+		// send server error as response
+		if err != nil {
+			log.Printf("Server Error %v\n", err)
+			writeError(w, 500, CodeInternalError, "Internal server error")
+		} else {
+			booksByte, _ := json.Marshal(books)
+			w.Write(booksByte)
+		}
 	}
+}
+
+// List books handler for GET /books
+// supports ?limit=&offset=, ?author=&title=, ?currency=&min_price=&max_price= and ?sort=[-]title|author|price
+func handleListBooks(store BookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		opts, fields := parseListOptions(r.URL.Query())
+		if len(fields) > 0 {
+			writeError(w, 400, CodeBadRequest, "Invalid query", fields...)
+			return
+		}
+
+		books, err := store.List()
+		if err != nil {
+			log.Printf("Server Error %v\n", err)
+			writeError(w, 500, CodeInternalError, "Internal server error")
+			return
+		}
 
+		books = filterBooks(books, opts)
+		sortBooks(books, opts.Sort, opts.Desc)
+		page := BookPage{Books: paginateBooks(books, opts.Limit, opts.Offset), Total: len(books), Limit: opts.Limit, Offset: opts.Offset}
+		pageByte, _ := json.Marshal(page)
+		w.Write(pageByte)
+	}
 }
 
 // get book by id handler
-func handleGetBookById(w http.ResponseWriter, r *http.Request) {
+func handleGetBookById(store BookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
-	query := r.URL.Query()
-	// get book id from URL
-	bookId := query.Get("id")
-	book, _, err := getBookById(bookId)
-	// send server error as response
-	if err != nil {
-		log.Printf("Server Error %v\n", err)
-		w.WriteHeader(500)
-		w.Write(jsonMessageByte("Internal server error"))
-	} else {
+		query := r.URL.Query()
+		// get book id from URL
+		bookId := query.Get("id")
+		book, err := store.Get(bookId)
 		// check requested book exists or not
-		if (Book{}) == book {
-			w.Write(jsonMessageByte("Book Not found"))
+		if err != nil {
+			writeStoreError(w, err)
 		} else {
-			bookByte, _ := json.Marshal(book)
-			w.Write(bookByte)
+			writeBook(w, 200, book)
 		}
 	}
 }
 
 // add book handler
-func handleAddBook(w http.ResponseWriter, r *http.Request) {
-	// check for post method
-	if r.Method != "POST" {
-		w.WriteHeader(405)
-		w.Write(jsonMessageByte(r.Method + " - Method not allowed"))
-	} else {
+func handleAddBook(store BookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		store := actingAs(store, r)
+		// check for post method
+		if r.Method != "POST" {
+			writeError(w, 405, CodeMethodNotAllowed, r.Method+" - Method not allowed")
+			return
+		}
 		// read the body
 		newBookByte, err := ioutil.ReadAll(r.Body)
 		// check for valid data from client
 		if err != nil {
 			log.Printf("Client Error %v\n", err)
-			w.WriteHeader(400)
-			w.Write(jsonMessageByte("Bad Request"))
-		} else {
-			books, _ := getBooks() // get all books
-			var newBooks []Book    // to add new book
+			writeError(w, 400, CodeBadRequest, "Bad Request")
+			return
+		}
 
-			json.Unmarshal(newBookByte, &newBooks) // new book added
-			books = append(books, newBooks...)     // add both
-			// Write all the books in books.json file
-			err = saveBooks(books)
-			// send server error as response
-			if err != nil {
-				log.Printf("Server Error %v\n", err)
-				w.WriteHeader(500)
-				w.Write(jsonMessageByte("Internal server error"))
-			} else {
-				w.Write(jsonMessageByte("New book added successfully"))
-			}
+		var newBooks []Book // to add new book
+		err = json.Unmarshal(newBookByte, &newBooks)
+		if err != nil {
+			checkError(err)
+			writeBodyError(w, err, "Bad Request - body must be a json array of books")
+			return
+		}
+		if len(newBooks) == 0 {
+			writeError(w, 400, CodeBadRequest, "Bad Request - no books to add")
+			return
+		}
+
+		// check required fields of every book
+		var fields []FieldError
+		for i, newBook := range newBooks {
+			newBooks[i].Cover = nil
+			fields = append(fields, validateBook(newBook, fmt.Sprintf("[%d].", i))...)
+		}
+		if len(fields) > 0 {
+			writeError(w, 422, CodeValidationFailed, "Invalid book", fields...)
+			return
+		}
 
+		// Write all the books in the store
+		err = store.Add(newBooks...)
+		if err != nil {
+			writeStoreError(w, err)
+		} else {
+			w.Write(jsonMessageByte("New book added successfully"))
 		}
 	}
 }
 
 // update book handler
-func handleUpdateBook(w http.ResponseWriter, r *http.Request) {
-	// check for post method
-	if r.Method != "POST" {
-		w.WriteHeader(405)
-		w.Write(jsonMessageByte(r.Method + " - Method not allowed"))
-	} else {
+func handleUpdateBook(store BookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		store := actingAs(store, r)
+		// check for post method
+		if r.Method != "POST" {
+			writeError(w, 405, CodeMethodNotAllowed, r.Method+" - Method not allowed")
+			return
+		}
 		// read the body
 		updateBookByte, err := ioutil.ReadAll(r.Body)
 		// check for valid data from client
 		if err != nil {
 			log.Printf("Client Error %v\n", err)
-			w.WriteHeader(400)
-			w.Write(jsonMessageByte("Bad Request"))
-		} else {
-			var updateBook Book // to update a book
+			writeError(w, 400, CodeBadRequest, "Bad Request")
+			return
+		}
 
-			err = json.Unmarshal(updateBookByte, &updateBook) // new book added
+		var updateBook Book // to update a book
+		err = json.Unmarshal(updateBookByte, &updateBook)
+		if err != nil {
 			checkError(err)
-			id := updateBook.Id
-
-			book, _, _ := getBookById(id)
-			// check requested book exists or not
-			if (Book{}) == book {
-				w.Write(jsonMessageByte("Book Not found"))
-			} else {
-				books, _ := getBooks()
+			writeBodyError(w, err, "Bad Request - body must be a json book")
+			return
+		}
+		if fields := validateBook(updateBook, ""); len(fields) > 0 {
+			writeError(w, 422, CodeValidationFailed, "Invalid book", fields...)
+			return
+		}
+		if !applyIfMatch(w, r, &updateBook.Version) {
+			return
+		}
+		keepCover(store, &updateBook)
 
-				for i, book := range books {
-					if book.Id == updateBook.Id {
-						books[i] = updateBook
-					}
-				}
-				// write books in books.json
-				err = saveBooks(books)
-				// send server error as response
-				if err != nil {
-					log.Printf("Server Error %v\n", err)
-					w.WriteHeader(500)
-					w.Write(jsonMessageByte("Internal server error"))
-				} else {
-					w.Write(jsonMessageByte("Book updated successfully"))
-				}
-			}
+		// write book in the store
+		change, err := store.Update(updateBook)
+		if err != nil {
+			writeStoreError(w, err)
+		} else {
+			w.Header().Set("ETag", bookETag(change.After))
+			w.Write(jsonMessageByte("Book updated successfully"))
 		}
 	}
 }
 
 // delete book by id handler
-func handleDeleteBookById(w http.ResponseWriter, r *http.Request) {
+func handleDeleteBookById(store BookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		store := actingAs(store, r)
 
-	query := r.URL.Query()
-	// get book id from URL
-	bookId := query.Get("id")
-	book, book_index, err := getBookById(bookId)
-	// send server error as response
-	if err != nil {
-		log.Printf("Server Error %v\n", err)
-		w.WriteHeader(500)
-		w.Write(jsonMessageByte("Internal server error"))
-	} else {
-		// check requested book exists or not
-		if (Book{}) == book {
-			w.Write(jsonMessageByte("Book Not found"))
+		query := r.URL.Query()
+		// get book id from URL
+		bookId := query.Get("id")
+		var version int64
+		if !applyIfMatch(w, r, &version) {
+			return
+		}
+		_, err := store.Delete(bookId, version)
+		// check requested book exists and was not modified
+		if err != nil {
+			writeStoreError(w, err)
 		} else {
-			books, _ := getBooks()
-			// remove books from slice
-			books = append(books[:book_index], books[book_index+1:]...)
-			saveBooks(books)
 			w.Write(jsonMessageByte("Book deleted successfully"))
 		}
 	}
 }
 
-// Get books - returns books and error
-func getBooks() ([]Book, error) {
-	books := []Book{}
-	booksByte, err := ioutil.ReadFile("./books.json")
-	if err != nil {
-		return nil, err
+// get book handler for GET /books/{id}
+func handleGetBook(store BookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		book, err := store.Get(mux.Vars(r)["id"])
+		if err != nil {
+			writeStoreError(w, err)
+		} else {
+			writeBook(w, 200, book)
+		}
 	}
-	err = json.Unmarshal(booksByte, &books)
-	if err != nil {
-		return nil, err
+}
+
+// create book handler for POST /books
+func handleCreateBook(store BookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		store := actingAs(store, r)
+		var newBook Book
+		err := json.NewDecoder(r.Body).Decode(&newBook)
+		if err != nil {
+			checkError(err)
+			writeBodyError(w, err, "Bad Request - body must be a json book")
+			return
+		}
+		if fields := validateBook(newBook, ""); len(fields) > 0 {
+			writeError(w, 422, CodeValidationFailed, "Invalid book", fields...)
+			return
+		}
+		newBook.Cover = nil
+
+		err = store.Add(newBook)
+		if err != nil {
+			writeStoreError(w, err)
+		} else {
+			// new books always start at version 1 outside trash, like the store keeps them
+			newBook.Version = 1
+			newBook.DeletedAt = nil
+			w.Header().Set("Location", "/books/"+newBook.Id)
+			writeBook(w, 201, newBook)
+		}
 	}
-	return books, nil
 }
 
-// Get books - returns book, book index and error
-func getBookById(id string) (Book, int, error) {
-	books, err := getBooks()
-	var requestedBook Book
-	var requestedBookIndex int
+// replace book handler for PUT /books/{id}
+func handleReplaceBook(store BookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		store := actingAs(store, r)
+		id := mux.Vars(r)["id"]
+		var updateBook Book
+		err := json.NewDecoder(r.Body).Decode(&updateBook)
+		if err != nil {
+			checkError(err)
+			writeBodyError(w, err, "Bad Request - body must be a json book")
+			return
+		}
+		// id in the body is optional, but must match the URL
+		if updateBook.Id != "" && updateBook.Id != id {
+			writeError(w, 422, CodeValidationFailed, "Invalid book", FieldError{"id", "id does not match URL"})
+			return
+		}
+		updateBook.Id = id
+		if !applyIfMatch(w, r, &updateBook.Version) {
+			return
+		}
+
+		writeUpdatedBook(w, store, updateBook)
+	}
+}
+
+// patch book handler for PATCH /books/{id}
+// body is a JSON Merge Patch (RFC 7396) or, with application/json-patch+json,
+// a JSON Patch (RFC 6902). The patched book is validated like a PUT
+func handlePatchBook(store BookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		store := actingAs(store, r)
+		mediaType := strings.TrimSpace(strings.SplitN(r.Header.Get("Content-Type"), ";", 2)[0])
+		if mediaType != "" && mediaType != MERGE_PATCH && mediaType != JSON_PATCH && mediaType != "application/json" {
+			w.Header().Set("Accept-Patch", MERGE_PATCH+", "+JSON_PATCH)
+			writeError(w, 415, CodeUnsupportedMedia, mediaType+" - Unsupported patch format")
+			return
+		}
+
+		id := mux.Vars(r)["id"]
+		book, err := store.Get(id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+
+		patchByte, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("Client Error %v\n", err)
+			writeError(w, 400, CodeBadRequest, "Bad Request")
+			return
+		}
+		patched, err := patchBook(book, mediaType == JSON_PATCH, patchByte)
+		if err != nil {
+			checkError(err)
+			writePatchError(w, err)
+			return
+		}
+		// id of the resource can not be patched
+		if patched.Id != id {
+			writeError(w, 422, CodeValidationFailed, "Invalid book", FieldError{"id", "id can not be changed"})
+			return
+		}
+		// version is not part of the patch, without If-Match the version
+		// read above protects from concurrent updates
+		patched.Version = book.Version
+		if !applyIfMatch(w, r, &patched.Version) {
+			return
+		}
+
+		writeUpdatedBook(w, store, patched)
+	}
+}
+
+// send error response for a patch which can not be applied
+func writePatchError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrInvalidPatch) {
+		writeError(w, 400, CodeBadRequest, err.Error())
+	} else if errors.Is(err, ErrPatchTestFailed) {
+		writeError(w, 409, CodeConflict, err.Error())
+	} else if errors.Is(err, ErrInvalidPrice) {
+		writeError(w, 422, CodeValidationFailed, "Invalid book", FieldError{"price", err.Error()})
+	} else {
+		writeError(w, 422, CodeValidationFailed, err.Error())
+	}
+}
 
+// validate and update book in the store, send it back as response
+func writeUpdatedBook(w http.ResponseWriter, store BookStore, book Book) {
+	if fields := validateBook(book, ""); len(fields) > 0 {
+		writeError(w, 422, CodeValidationFailed, "Invalid book", fields...)
+		return
+	}
+	keepCover(store, &book)
+	change, err := store.Update(book)
 	if err != nil {
-		return Book{}, 0, err
+		writeStoreError(w, err)
+	} else {
+		writeBook(w, 200, change.After)
 	}
+}
 
-	for i, book := range books {
-		if book.Id == id {
-			requestedBook = book
-			requestedBookIndex = i
+// covers are set only through PUT /books/{id}/cover, other updates keep the stored one
+func keepCover(store BookStore, book *Book) {
+	book.Cover = nil
+	if stored, err := store.Get(book.Id); err == nil {
+		book.Cover = stored.Cover
+	}
+}
+
+// delete book handler for DELETE /books/{id}
+func handleDeleteBook(store BookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		store := actingAs(store, r)
+		var version int64
+		if !applyIfMatch(w, r, &version) {
+			return
+		}
+		_, err := store.Delete(mux.Vars(r)["id"], version)
+		if err != nil {
+			writeStoreError(w, err)
+		} else {
+			w.WriteHeader(204)
 		}
 	}
+}
+
+// export catalog handler for GET /books/export?format=csv|ndjson
+func handleExportBooks(store BookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "csv"
+		}
+		if format != "csv" && format != "ndjson" {
+			writeError(w, 400, CodeBadRequest, "Invalid query", FieldError{"format", "format must be csv or ndjson"})
+			return
+		}
+
+		books, err := store.List()
+		if err != nil {
+			log.Printf("Server Error %v\n", err)
+			writeError(w, 500, CodeInternalError, "Internal server error")
+			return
+		}
 
-	return requestedBook, requestedBookIndex, nil
+		w.Header().Set("Content-Type", catalogContentTypes[format])
+		w.Header().Set("Content-Disposition", "attachment; filename=books."+format)
+		checkError(writeCatalog(w, format, books))
+	}
 }
 
-// save books to books.json file
-func saveBooks(books []Book) error {
+// import catalog handler for POST /books/import?format=csv|ndjson&mode=insert|upsert
+// valid rows are imported, invalid ones are reported in the result
+func handleImportBooks(store BookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		store := actingAs(store, r)
+		query := r.URL.Query()
+		format := query.Get("format")
+		if format == "" {
+			format = catalogFormat(r.Header.Get("Content-Type"))
+		}
+		var fields []FieldError
+		if format != "csv" && format != "ndjson" {
+			fields = append(fields, FieldError{"format", "format must be csv or ndjson"})
+		}
+		mode := query.Get("mode")
+		if mode == "" {
+			mode = "insert"
+		}
+		if mode != "insert" && mode != "upsert" {
+			fields = append(fields, FieldError{"mode", "mode must be insert or upsert"})
+		}
+		if len(fields) > 0 {
+			writeError(w, 400, CodeBadRequest, "Invalid query", fields...)
+			return
+		}
+
+		rows, err := readCatalog(r.Body, format)
+		if err != nil {
+			checkError(err)
+			writeError(w, 400, CodeBadRequest, "Bad Request - "+err.Error())
+			return
+		}
 
-	// converting into bytes for writing into a file
-	booksBytes, err := json.Marshal(books)
+		result := importCatalog(store, rows, mode == "upsert")
+		resultByte, _ := json.Marshal(result)
+		w.Write(resultByte)
+	}
+}
 
-	checkError(err)
+// search handler for GET /books/search?q=&limit=
+func handleSearchBooks(store BookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		var fields []FieldError
+		q := strings.TrimSpace(query.Get("q"))
+		if len(tokenize(q)) == 0 {
+			fields = append(fields, FieldError{"q", "q must contain at least one word"})
+		}
+		opts, limitFields := parseListOptions(url.Values{"limit": query["limit"]})
+		fields = append(fields, limitFields...)
+		if len(fields) > 0 {
+			writeError(w, 400, CodeBadRequest, "Invalid query", fields...)
+			return
+		}
 
-	err = ioutil.WriteFile("./books.json", booksBytes, 0644)
+		hits, err := searchBooks(store, q, opts.Limit)
+		if err != nil {
+			log.Printf("Server Error %v\n", err)
+			writeError(w, 500, CodeInternalError, "Internal server error")
+			return
+		}
+		resultByte, _ := json.Marshal(SearchResult{q, len(hits), hits})
+		w.Write(resultByte)
+	}
+}
 
-	return err
+// history handler for GET /books/{id}/history, oldest change first
+func handleGetBookHistory(store BookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		history, ok := store.(BookHistory)
+		if !ok {
+			writeError(w, 404, CodeNotFound, "History is not recorded")
+			return
+		}
+		entries, err := history.History(id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if len(entries) == 0 {
+			writeError(w, 404, CodeNotFound, "Book not found")
+			return
+		}
+		historyByte, _ := json.Marshal(entries)
+		w.Write(historyByte)
+	}
+}
+
+// trash listing handler for GET /books/trash
+func handleGetTrash(store BookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		books, err := store.Trash()
+		if err != nil {
+			log.Printf("Server Error %v\n", err)
+			writeError(w, 500, CodeInternalError, "Internal server error")
+		} else {
+			booksByte, _ := json.Marshal(books)
+			w.Write(booksByte)
+		}
+	}
+}
+
+// upload cover handler for PUT /books/{id}/cover
+// body is the JPEG, PNG or GIF image, If-Match is checked like for PUT /books/{id}
+func handleUploadCover(store BookStore, covers *CoverStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		store := actingAs(store, r)
+		mediaType := strings.TrimSpace(strings.SplitN(r.Header.Get("Content-Type"), ";", 2)[0])
+		if mediaType != "" && !strings.HasPrefix(mediaType, "image/") && mediaType != "application/octet-stream" {
+			writeError(w, 415, CodeUnsupportedMedia, mediaType+" - Unsupported cover format")
+			return
+		}
+		book, err := store.Get(mux.Vars(r)["id"])
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if !applyIfMatch(w, r, &book.Version) {
+			return
+		}
+
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MAX_COVER_SIZE))
+		if err != nil {
+			log.Printf("Client Error %v\n", err)
+			writeError(w, 413, CodeTooLarge, fmt.Sprintf("Cover is larger than %d bytes", MAX_COVER_SIZE))
+			return
+		}
+		cover, err := covers.Save(data)
+		if errors.Is(err, ErrInvalidCover) {
+			writeError(w, 415, CodeUnsupportedMedia, "Cover must be a JPEG, PNG or GIF image")
+			return
+		} else if err != nil {
+			log.Printf("Server Error %v\n", err)
+			writeError(w, 500, CodeInternalError, "Internal server error")
+			return
+		}
+
+		book.Cover = &cover
+		change, err := store.Update(book)
+		if err != nil {
+			writeStoreError(w, err)
+		} else {
+			writeBook(w, 200, change.After)
+		}
+	}
+}
+
+// remove cover handler for DELETE /books/{id}/cover
+// the image file is kept, other books may use the same image
+func handleDeleteCover(store BookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		store := actingAs(store, r)
+		book, err := store.Get(mux.Vars(r)["id"])
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if !applyIfMatch(w, r, &book.Version) {
+			return
+		}
+		book.Cover = nil
+		change, err := store.Update(book)
+		if err != nil {
+			writeStoreError(w, err)
+		} else {
+			writeBook(w, 200, change.After)
+		}
+	}
+}
+
+// cover image handler for GET /covers/{name}
+func handleGetCover(covers *CoverStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path, ok := covers.Path(mux.Vars(r)["name"])
+		if !ok {
+			writeError(w, 404, CodeNotFound, "Cover not found")
+			return
+		}
+		// names are hashes of the content, so it never changes
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		http.ServeFile(w, r, path)
+	}
+}
+
+// restore book handler for POST /books/{id}/restore
+func handleRestoreBook(store BookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		store := actingAs(store, r)
+		change, err := store.Restore(mux.Vars(r)["id"])
+		if errors.Is(err, ErrBookNotFound) {
+			writeError(w, 404, CodeNotFound, "Book is not in trash")
+		} else if err != nil {
+			writeStoreError(w, err)
+		} else {
+			writeBook(w, 200, change.After)
+		}
+	}
+}
+
+// register all the book routes
+// reads are public, changes need a token accepted by verifier
+// book creation is replayed from idempotency for retries with the same Idempotency-Key
+func NewRouter(store BookStore, verifier *TokenVerifier, covers *CoverStore, idempotency *IdempotencyCache) *mux.Router {
+	router := mux.NewRouter()
+	auth := func(handler http.HandlerFunc) http.HandlerFunc {
+		return requireToken(verifier, handler)
+	}
+	create := func(handler http.HandlerFunc) http.HandlerFunc {
+		return requireToken(verifier, idempotent(idempotency, handler))
+	}
+
+	router.HandleFunc("/books", handleListBooks(store)).Methods("GET")
+	router.HandleFunc("/books", create(handleCreateBook(store))).Methods("POST")
+	router.HandleFunc("/books/export", handleExportBooks(store)).Methods("GET")
+	router.HandleFunc("/books/import", auth(handleImportBooks(store))).Methods("POST")
+	router.HandleFunc("/books/trash", handleGetTrash(store)).Methods("GET")
+	router.HandleFunc("/books/search", handleSearchBooks(store)).Methods("GET")
+	router.HandleFunc("/books/{id}/restore", auth(handleRestoreBook(store))).Methods("POST")
+	router.HandleFunc("/books/{id}/history", handleGetBookHistory(store)).Methods("GET")
+	router.HandleFunc("/books/{id}/cover", auth(handleUploadCover(store, covers))).Methods("PUT")
+	router.HandleFunc("/books/{id}/cover", auth(handleDeleteCover(store))).Methods("DELETE")
+	router.HandleFunc("/covers/{name}", handleGetCover(covers)).Methods("GET", "HEAD")
+	router.HandleFunc("/books/{id}", handleGetBook(store)).Methods("GET")
+	router.HandleFunc("/books/{id}", auth(handleReplaceBook(store))).Methods("PUT")
+	router.HandleFunc("/books/{id}", auth(handlePatchBook(store))).Methods("PATCH")
+	router.HandleFunc("/books/{id}", auth(handleDeleteBook(store))).Methods("DELETE")
+
+	registerLegacyRoutes(router, store, auth, create)
+
+	// unknown routes and methods get the same error envelope
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, 404, CodeNotFound, r.URL.Path+" - Not found")
+	})
+	router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, 405, CodeMethodNotAllowed, r.Method+" - Method not allowed")
+	})
+
+	return router
+}
+
+// old routes used by existing clients and the postman collection
+// they keep their original methods and responses
+func registerLegacyRoutes(router *mux.Router, store BookStore, auth func(http.HandlerFunc) http.HandlerFunc, create func(http.HandlerFunc) http.HandlerFunc) {
+	router.HandleFunc("/", handleGetBooks(store))
+	router.HandleFunc("/book", handleGetBookById(store))
+	router.HandleFunc("/add", create(handleAddBook(store)))
+	router.HandleFunc("/update", auth(handleUpdateBook(store)))
+	router.HandleFunc("/delete", auth(handleDeleteBookById(store)))
+}
+
+// read listing options from query, returns field errors for invalid values
+func parseListOptions(query url.Values) (ListOptions, []FieldError) {
+	opts := ListOptions{Limit: DEFAULT_LIMIT}
+	var fields []FieldError
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > MAX_LIMIT {
+			fields = append(fields, FieldError{"limit", fmt.Sprintf("limit must be a number between 1 and %d", MAX_LIMIT)})
+		}
+		opts.Limit = limit
+	}
+	if value := query.Get("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			fields = append(fields, FieldError{"offset", "offset must be a positive number"})
+		}
+		opts.Offset = offset
+	}
+	// price bounds are in currency, DEFAULT_CURRENCY when it is not given
+	opts.Currency = query.Get("currency")
+	if opts.Currency != "" && !isCurrencyCode(opts.Currency) {
+		fields = append(fields, FieldError{"currency", "currency must be a three letter code like INR"})
+	}
+	for _, name := range []string{"min_price", "max_price"} {
+		if value := query.Get(name); value != "" {
+			if opts.Currency == "" {
+				opts.Currency = DEFAULT_CURRENCY
+			}
+			price, err := parseAmount(value, opts.Currency)
+			if err != nil {
+				fields = append(fields, FieldError{name, name + " must be a number"})
+			} else if name == "min_price" {
+				opts.MinPrice = &price
+			} else {
+				opts.MaxPrice = &price
+			}
+		}
+	}
+	opts.Sort = strings.TrimPrefix(query.Get("sort"), "-")
+	opts.Desc = strings.HasPrefix(query.Get("sort"), "-")
+	if opts.Sort != "" && opts.Sort != "title" && opts.Sort != "author" && opts.Sort != "price" {
+		fields = append(fields, FieldError{"sort", "sort must be one of title, author, price"})
+	}
+	opts.Author = query.Get("author")
+	opts.Title = query.Get("title")
+
+	return opts, fields
+}
+
+// keep books matching author and title substrings, currency and price range
+func filterBooks(books []Book, opts ListOptions) []Book {
+	filtered := []Book{}
+	for _, book := range books {
+		if !containsFold(book.Author, opts.Author) || !containsFold(book.Title, opts.Title) {
+			continue
+		}
+		if opts.Currency != "" && book.Price.Currency != opts.Currency {
+			continue
+		}
+		if opts.MinPrice != nil || opts.MaxPrice != nil {
+			price := book.Price.Amount
+			if (opts.MinPrice != nil && price < *opts.MinPrice) || (opts.MaxPrice != nil && price > *opts.MaxPrice) {
+				continue
+			}
+		}
+		filtered = append(filtered, book)
+	}
+	return filtered
+}
+
+// case insensitive substring check
+func containsFold(s string, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// sort books by title, author or price, unknown field keeps the store order
+// prices are sorted within their currency, currencies by code
+func sortBooks(books []Book, sortBy string, desc bool) {
+	var less func(a Book, b Book) bool
+	switch sortBy {
+	case "title":
+		less = func(a Book, b Book) bool { return strings.ToLower(a.Title) < strings.ToLower(b.Title) }
+	case "author":
+		less = func(a Book, b Book) bool { return strings.ToLower(a.Author) < strings.ToLower(b.Author) }
+	case "price":
+		less = func(a Book, b Book) bool {
+			if a.Price.Currency != b.Price.Currency {
+				return a.Price.Currency < b.Price.Currency
+			}
+			return a.Price.Amount < b.Price.Amount
+		}
+	default:
+		return
+	}
+	sort.SliceStable(books, func(i, j int) bool {
+		if desc {
+			return less(books[j], books[i])
+		}
+		return less(books[i], books[j])
+	})
+}
+
+// cut a page out of the books
+func paginateBooks(books []Book, limit int, offset int) []Book {
+	if offset >= len(books) {
+		return []Book{}
+	}
+	end := offset + limit
+	if end > len(books) {
+		end = len(books)
+	}
+	return books[offset:end]
+}
+
+// parse price like "600", "4000.5" or "599.99 USD"
+// price without currency is in DEFAULT_CURRENCY
+func ParseMoney(s string) (Money, error) {
+	amount, currency := s, DEFAULT_CURRENCY
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		amount, currency = s[:i], s[i+1:]
+	}
+	if !isCurrencyCode(currency) {
+		return Money{}, fmt.Errorf("%w: currency %q", ErrInvalidPrice, currency)
+	}
+	minor, err := parseAmount(amount, currency)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{minor, currency}, nil
+}
+
+// number of minor digits of currency, 2 for most currencies
+func minorDigits(currency string) int {
+	if digits, ok := CURRENCY_DIGITS[currency]; ok {
+		return digits
+	}
+	return 2
+}
+
+// parse decimal amount of currency into minor units
+// it may have at most as many fraction digits as the currency has minor digits
+func parseAmount(s string, currency string) (int64, error) {
+	digits := minorDigits(currency)
+	units, fraction := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		units, fraction = s[:i], s[i+1:]
+		if fraction == "" {
+			return 0, fmt.Errorf("%w: amount %q", ErrInvalidPrice, s)
+		}
+	}
+	if units == "" || len(fraction) > digits || !isDigits(units) || !isDigits(fraction) {
+		return 0, fmt.Errorf("%w: amount %q has more than %d fraction digits for %s", ErrInvalidPrice, s, digits, currency)
+	}
+	fraction += strings.Repeat("0", digits-len(fraction))
+	minor, err := strconv.ParseInt(units+fraction, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: amount %q", ErrInvalidPrice, s)
+	}
+	return minor, nil
+}
+
+// check all the characters are ascii digits
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// check currency is three upper case letters, like ISO 4217 codes
+func isCurrencyCode(s string) bool {
+	if len(s) != 3 {
+		return false
+	}
+	for _, c := range s {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// amount as decimal string with the minor digits of the currency, e.g. "600.00" or "1500" for JPY
+func (m Money) AmountString() string {
+	digits := minorDigits(m.Currency)
+	if digits == 0 {
+		return strconv.FormatInt(m.Amount, 10)
+	}
+	scale := int64(math.Pow10(digits))
+	return fmt.Sprintf("%d.%0*d", m.Amount/scale, digits, m.Amount%scale)
+}
+
+// price as "600.00 INR"
+func (m Money) String() string {
+	return m.AmountString() + " " + m.Currency
+}
+
+// price as {"amount":"600.00","currency":"INR"}
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   string `json:"amount"`
+		Currency string `json:"currency"`
+	}{m.AmountString(), m.Currency})
+}
+
+// accepts {"amount":"600.00","currency":"INR"}, amount may also be a number,
+// and the legacy "600" string format of old books.json files
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var legacy string
+	if json.Unmarshal(data, &legacy) == nil {
+		price, err := ParseMoney(legacy)
+		if err != nil {
+			return err
+		}
+		*m = price
+		return nil
+	}
+
+	var price struct {
+		Amount   json.RawMessage `json:"amount"`
+		Currency string          `json:"currency"`
+	}
+	if err := json.Unmarshal(data, &price); err != nil {
+		return err
+	}
+	amount := string(price.Amount)
+	if unquoted, err := strconv.Unquote(amount); err == nil {
+		amount = unquoted
+	}
+	if !isCurrencyCode(price.Currency) {
+		return fmt.Errorf("%w: currency %q", ErrInvalidPrice, price.Currency)
+	}
+	minor, err := parseAmount(amount, price.Currency)
+	if err != nil {
+		return err
+	}
+	*m = Money{minor, price.Currency}
+	return nil
+}
+
+// Get books - returns books and error
+func getBooks(path string) ([]Book, error) {
+	books := []Book{}
+	booksByte, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(booksByte, &books)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCorruptCatalog, path, err)
+	}
+	return books, nil
+}
+
+// Get books - returns book, book index and error
+func getBookById(books []Book, id string) (Book, int, error) {
+	for i, book := range books {
+		if book.Id == id {
+			return book, i, nil
+		}
+	}
+
+	return Book{}, -1, ErrBookNotFound
+}
+
+// check new books do not clash with stored ones or with each other
+// and start them at version 1 outside trash
+func checkNewBooks(books []Book, newBooks []Book) error {
+	for i := range newBooks {
+		newBooks[i].Version = 1
+		newBooks[i].DeletedAt = nil
+	}
+	return checkImportedBooks(books, newBooks)
+}
+
+// check imported books have unique ids, they keep their version and deleted_at
+func checkImportedBooks(books []Book, newBooks []Book) error {
+	for i, newBook := range newBooks {
+		if newBook.Version < 1 {
+			newBooks[i].Version = 1
+		}
+		if _, _, err := getBookById(books, newBook.Id); err == nil {
+			return fmt.Errorf("%w: %s", ErrBookExists, newBook.Id)
+		}
+		if _, _, err := getBookById(newBooks[:i], newBook.Id); err == nil {
+			return fmt.Errorf("%w: %s", ErrBookExists, newBook.Id)
+		}
+	}
+	return nil
+}
+
+// add new books and replace stored ones with the same id, the replaced
+// books keep their cover and get the next version, books in trash are an error
+// books is changed in place, pass a copy when the change must be all or nothing
+func upsertBooks(books []Book, newBooks []Book) ([]Book, []BookChange, error) {
+	changes := make([]BookChange, 0, len(newBooks))
+	for _, book := range newBooks {
+		book.DeletedAt = nil
+		stored, i, err := getBookById(books, book.Id)
+		if err != nil {
+			book.Version = 1
+			books = append(books, book)
+			changes = append(changes, BookChange{nil, book})
+			continue
+		}
+		if stored.DeletedAt != nil {
+			return nil, nil, fmt.Errorf("%w: %s is in trash", ErrBookNotFound, book.Id)
+		}
+		book.Version = stored.Version + 1
+		book.Cover = stored.Cover
+		books[i] = book
+		changes = append(changes, BookChange{&stored, book})
+	}
+	return books, changes, nil
+}
+
+// books which are not in trash
+func activeBooks(books []Book) []Book {
+	active := []Book{}
+	for _, book := range books {
+		if book.DeletedAt == nil {
+			active = append(active, book)
+		}
+	}
+	return active
+}
+
+// books in trash
+func trashedBooks(books []Book) []Book {
+	trashed := []Book{}
+	for _, book := range books {
+		if book.DeletedAt != nil {
+			trashed = append(trashed, book)
+		}
+	}
+	return trashed
+}
+
+// get book which is not in trash - returns book, book index and error
+func getActiveBook(books []Book, id string) (Book, int, error) {
+	book, i, err := getBookById(books, id)
+	if err == nil && book.DeletedAt != nil {
+		return Book{}, -1, ErrBookNotFound
+	}
+	return book, i, err
+}
+
+// replace stored book with the same id and increment its version
+func updateBook(books []Book, book Book) (BookChange, error) {
+	stored, i, err := getActiveBook(books, book.Id)
+	if err != nil {
+		return BookChange{}, err
+	}
+	if book.Version != 0 && book.Version != stored.Version {
+		return BookChange{}, fmt.Errorf("%w: %s is at version %d", ErrVersionMismatch, book.Id, stored.Version)
+	}
+	book.Version = stored.Version + 1
+	book.DeletedAt = nil
+	books[i] = book
+	return BookChange{&stored, book}, nil
+}
+
+// move book with the given id and version to trash
+func deleteBook(books []Book, id string, version int64, deletedAt time.Time) (BookChange, error) {
+	stored, i, err := getActiveBook(books, id)
+	if err != nil {
+		return BookChange{}, err
+	}
+	if version != 0 && version != stored.Version {
+		return BookChange{}, fmt.Errorf("%w: %s is at version %d", ErrVersionMismatch, id, stored.Version)
+	}
+	books[i].Version++
+	books[i].DeletedAt = &deletedAt
+	return BookChange{&stored, books[i]}, nil
+}
+
+// take book with the given id out of trash
+func restoreBook(books []Book, id string) (BookChange, error) {
+	stored, i, err := getBookById(books, id)
+	if err != nil || stored.DeletedAt == nil {
+		return BookChange{}, fmt.Errorf("%w: %s is not in trash", ErrBookNotFound, id)
+	}
+	books[i].Version++
+	books[i].DeletedAt = nil
+	return BookChange{&stored, books[i]}, nil
+}
+
+// remove books deleted before the given time, returns the kept books and
+// the removed ones
+func purgeBooks(books []Book, deletedBefore time.Time) ([]Book, []Book) {
+	kept := []Book{}
+	purged := []Book{}
+	for _, book := range books {
+		if book.DeletedAt == nil || !book.DeletedAt.Before(deletedBefore) {
+			kept = append(kept, book)
+		} else {
+			purged = append(purged, book)
+		}
+	}
+	return kept, purged
+}
+
+// save books to json file
+// books are written to a temp file first and renamed over the old one,
+// so a crash never leaves a half written catalog behind
+func saveBooks(path string, books []Book) error {
+
+	// converting into bytes for writing into a file
+	booksBytes, err := json.Marshal(books)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	// remove the temp file if anything below fails
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(booksBytes)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// rewrite books file stored with legacy string prices or without versions in the current format
+// returns true when the file was changed
+func migrateBooks(path string) (bool, error) {
+	booksByte, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	books, err := getBooks(path)
+	if err != nil {
+		return false, err
+	}
+	for i := range books {
+		if books[i].Version == 0 {
+			books[i].Version = 1
+		}
+	}
+	migratedByte, err := json.Marshal(books)
+	if err != nil || string(migratedByte) == string(booksByte) {
+		return false, err
+	}
+	return true, saveBooks(path, books)
+}
+
+// store which keeps the books in a json file
+// mutations are serialized, so concurrent requests do not lose updates
+// only one store may have the file open, e.g. the catalog command fails
+// while the server runs on the same file, see lockBooksFile
+type JSONFileStore struct {
+	mu   sync.RWMutex
+	path string
+	lock *os.File
+}
+
+// open store for given json file
+// missing file is created as an empty catalog, corrupt file is an error
+func NewJSONFileStore(path string) (*JSONFileStore, error) {
+	lock, err := lockBooksFile(path)
+	if err != nil {
+		return nil, err
+	}
+	migrated, err := migrateBooks(path)
+	if os.IsNotExist(err) {
+		err = saveBooks(path, []Book{})
+	}
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	if migrated {
+		log.Printf("Migrated %v to the current format\n", path)
+	}
+	return &JSONFileStore{path: path, lock: lock}, nil
+}
+
+// take the lock file next to the books file, the lock is released on Close
+// or when the process exits
+// the books file itself is replaced on every save, so it can not hold the lock
+func lockBooksFile(path string) (*os.File, error) {
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		err = fmt.Errorf("%w: %s, stop the server before changing it from the command line", ErrCatalogLocked, path)
+	}
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// Close the store and release the books file
+func (s *JSONFileStore) Close() error {
+	return s.lock.Close()
+}
+
+// List all the books in the file
+func (s *JSONFileStore) List() ([]Book, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	books, err := getBooks(s.path)
+	if err != nil {
+		return nil, err
+	}
+	return activeBooks(books), nil
+}
+
+// Get book by id from the file
+func (s *JSONFileStore) Get(id string) (Book, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	books, err := getBooks(s.path)
+	if err != nil {
+		return Book{}, err
+	}
+	book, _, err := getActiveBook(books, id)
+	return book, err
+}
+
+// Add books to the end of the file
+func (s *JSONFileStore) Add(newBooks ...Book) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	books, err := getBooks(s.path)
+	if err != nil {
+		return err
+	}
+	if err := checkNewBooks(books, newBooks); err != nil {
+		return err
+	}
+	return saveBooks(s.path, append(books, newBooks...))
+}
+
+// Upsert books of the file in one read and write
+func (s *JSONFileStore) Upsert(newBooks ...Book) ([]BookChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	books, err := getBooks(s.path)
+	if err != nil {
+		return nil, err
+	}
+	books, changes, err := upsertBooks(books, newBooks)
+	if err != nil {
+		return nil, err
+	}
+	return changes, saveBooks(s.path, books)
+}
+
+// Update the book with the same id in the file
+func (s *JSONFileStore) Update(book Book) (BookChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	books, err := getBooks(s.path)
+	if err != nil {
+		return BookChange{}, err
+	}
+	change, err := updateBook(books, book)
+	if err != nil {
+		return BookChange{}, err
+	}
+	return change, saveBooks(s.path, books)
+}
+
+// Delete book by id from the file, the book is moved to trash
+func (s *JSONFileStore) Delete(id string, version int64) (BookChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	books, err := getBooks(s.path)
+	if err != nil {
+		return BookChange{}, err
+	}
+	change, err := deleteBook(books, id, version, time.Now().UTC())
+	if err != nil {
+		return BookChange{}, err
+	}
+	return change, saveBooks(s.path, books)
+}
+
+// List the books in trash of the file
+func (s *JSONFileStore) Trash() ([]Book, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	books, err := getBooks(s.path)
+	if err != nil {
+		return nil, err
+	}
+	return trashedBooks(books), nil
+}
+
+// Restore book from trash of the file
+func (s *JSONFileStore) Restore(id string) (BookChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	books, err := getBooks(s.path)
+	if err != nil {
+		return BookChange{}, err
+	}
+	change, err := restoreBook(books, id)
+	if err != nil {
+		return BookChange{}, err
+	}
+	return change, saveBooks(s.path, books)
+}
+
+// Purge books deleted before the given time from the file
+func (s *JSONFileStore) Purge(deletedBefore time.Time) ([]Book, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	books, err := getBooks(s.path)
+	if err != nil {
+		return nil, err
+	}
+	books, purged := purgeBooks(books, deletedBefore)
+	if len(purged) == 0 {
+		return purged, nil
+	}
+	if err := saveBooks(s.path, books); err != nil {
+		return nil, err
+	}
+	return purged, nil
+}
+
+// store which keeps the books in memory, useful for tests
+type MemoryStore struct {
+	mu    sync.RWMutex
+	books []Book
+}
+
+// create store with the given books
+func NewMemoryStore(books ...Book) *MemoryStore {
+	store := &MemoryStore{books: append([]Book{}, books...)}
+	for i := range store.books {
+		if store.books[i].Version == 0 {
+			store.books[i].Version = 1
+		}
+	}
+	return store
+}
+
+// List all the books in memory
+func (s *MemoryStore) List() ([]Book, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return activeBooks(s.books), nil
+}
+
+// Get book by id from memory
+func (s *MemoryStore) Get(id string) (Book, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	book, _, err := getActiveBook(s.books, id)
+	return book, err
+}
+
+// Add books to memory
+func (s *MemoryStore) Add(newBooks ...Book) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := checkNewBooks(s.books, newBooks); err != nil {
+		return err
+	}
+	s.books = append(s.books, newBooks...)
+	return nil
+}
+
+// Upsert books in memory
+func (s *MemoryStore) Upsert(newBooks ...Book) ([]BookChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	books, changes, err := upsertBooks(append([]Book{}, s.books...), newBooks)
+	if err != nil {
+		return nil, err
+	}
+	s.books = books
+	return changes, nil
+}
+
+// Update the book with the same id in memory
+func (s *MemoryStore) Update(book Book) (BookChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return updateBook(s.books, book)
+}
+
+// Delete book by id from memory, the book is moved to trash
+func (s *MemoryStore) Delete(id string, version int64) (BookChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return deleteBook(s.books, id, version, time.Now().UTC())
+}
+
+// List the books in trash
+func (s *MemoryStore) Trash() ([]Book, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return trashedBooks(s.books), nil
+}
+
+// Restore book from trash
+func (s *MemoryStore) Restore(id string) (BookChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return restoreBook(s.books, id)
+}
+
+// Purge books deleted before the given time from memory
+func (s *MemoryStore) Purge(deletedBefore time.Time) ([]Book, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	books, purged := purgeBooks(s.books, deletedBefore)
+	s.books = books
+	return purged, nil
+}
+
+// row of the books table
+type bookRow struct {
+	Id            string       `db:"id"`
+	Title         string       `db:"title"`
+	Author        string       `db:"author"`
+	PriceAmount   int64        `db:"price_amount"`
+	PriceCurrency string       `db:"price_currency"`
+	Imageurl      string       `db:"image_url"`
+	Version       int64        `db:"version"`
+	DeletedAt     sql.NullTime `db:"deleted_at"`
+	// cover_url is empty when the book has no cover
+	CoverURL             string `db:"cover_url"`
+	CoverContentType     string `db:"cover_content_type"`
+	CoverSize            int64  `db:"cover_size"`
+	CoverWidth           int    `db:"cover_width"`
+	CoverHeight          int    `db:"cover_height"`
+	CoverThumbnailWidth  int    `db:"cover_thumbnail_width"`
+	CoverThumbnailHeight int    `db:"cover_thumbnail_height"`
+}
+
+// columns of the books table in the order of bookRow
+const bookColumns string = "id, title, author, price_amount, price_currency, image_url, version, deleted_at, " +
+	"cover_url, cover_content_type, cover_size, cover_width, cover_height, cover_thumbnail_width, cover_thumbnail_height"
+
+// convert row of the books table to book
+func (row bookRow) book() Book {
+	book := Book{
+		Id:       row.Id,
+		Title:    row.Title,
+		Author:   row.Author,
+		Price:    Money{row.PriceAmount, row.PriceCurrency},
+		Imageurl: row.Imageurl,
+		Version:  row.Version,
+	}
+	if row.CoverURL != "" {
+		book.Cover = &Cover{row.CoverURL, row.CoverContentType, row.CoverSize, row.CoverWidth, row.CoverHeight, row.CoverThumbnailWidth, row.CoverThumbnailHeight}
+	}
+	if row.DeletedAt.Valid {
+		deletedAt := row.DeletedAt.Time.UTC()
+		book.DeletedAt = &deletedAt
+	}
+	return book
+}
+
+// migrations of the books table, applied in order by goose
+var bookMigrations = []*goose.Migration{
+	goose.NewGoMigration(1,
+		&goose.GoFunc{RunTx: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `CREATE TABLE books (
+				id             VARCHAR(64) PRIMARY KEY,
+				position       BIGINT NOT NULL,
+				title          TEXT NOT NULL,
+				author         TEXT NOT NULL,
+				price_amount   BIGINT NOT NULL,
+				price_currency CHAR(3) NOT NULL,
+				image_url      TEXT NOT NULL DEFAULT '',
+				version        BIGINT NOT NULL DEFAULT 1
+			)`)
+			return err
+		}},
+		&goose.GoFunc{RunTx: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `DROP TABLE books`)
+			return err
+		}},
+	),
+	goose.NewGoMigration(2,
+		&goose.GoFunc{RunTx: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `CREATE UNIQUE INDEX books_position_idx ON books (position)`)
+			return err
+		}},
+		&goose.GoFunc{RunTx: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `DROP INDEX books_position_idx`)
+			return err
+		}},
+	),
+	goose.NewGoMigration(3,
+		&goose.GoFunc{RunTx: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `ALTER TABLE books ADD COLUMN deleted_at TIMESTAMP NULL`)
+			return err
+		}},
+		&goose.GoFunc{RunTx: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `ALTER TABLE books DROP COLUMN deleted_at`)
+			return err
+		}},
+	),
+	// one column per statement, sqlite can not add several at once
+	goose.NewGoMigration(4,
+		&goose.GoFunc{RunTx: func(ctx context.Context, tx *sql.Tx) error {
+			for _, column := range []string{
+				"cover_url TEXT NOT NULL DEFAULT ''",
+				"cover_content_type TEXT NOT NULL DEFAULT ''",
+				"cover_size BIGINT NOT NULL DEFAULT 0",
+				"cover_width INTEGER NOT NULL DEFAULT 0",
+				"cover_height INTEGER NOT NULL DEFAULT 0",
+				"cover_thumbnail_width INTEGER NOT NULL DEFAULT 0",
+				"cover_thumbnail_height INTEGER NOT NULL DEFAULT 0",
+			} {
+				if _, err := tx.ExecContext(ctx, "ALTER TABLE books ADD COLUMN "+column); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		&goose.GoFunc{RunTx: func(ctx context.Context, tx *sql.Tx) error {
+			for _, column := range []string{"cover_url", "cover_content_type", "cover_size", "cover_width", "cover_height", "cover_thumbnail_width", "cover_thumbnail_height"} {
+				if _, err := tx.ExecContext(ctx, "ALTER TABLE books DROP COLUMN "+column); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+	),
+	// last position handed out, its row is locked by every Add until commit
+	goose.NewGoMigration(5,
+		&goose.GoFunc{RunTx: func(ctx context.Context, tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, `CREATE TABLE book_positions (
+				id       INTEGER PRIMARY KEY,
+				position BIGINT NOT NULL
+			)`); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, `INSERT INTO book_positions (id, position) SELECT 1, COALESCE(MAX(position), 0) FROM books`)
+			return err
+		}},
+		&goose.GoFunc{RunTx: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `DROP TABLE book_positions`)
+			return err
+		}},
+	),
+}
+
+// values of the cover columns, zero values when the book has no cover
+func coverValues(cover *Cover) []interface{} {
+	if cover == nil {
+		cover = &Cover{}
+	}
+	return []interface{}{cover.URL, cover.ContentType, cover.Size, cover.Width, cover.Height, cover.ThumbnailWidth, cover.ThumbnailHeight}
+}
+
+// apply all the pending migrations of the books table
+// dialect is a goose dialect, e.g. "postgres" or "sqlite3"
+func migrateDB(db *sql.DB, dialect string) error {
+	provider, err := goose.NewProvider(goose.Dialect(dialect), db, nil, goose.WithGoMigrations(bookMigrations...))
+	if err != nil {
+		return err
+	}
+	results, err := provider.Up(context.Background())
+	for _, result := range results {
+		log.Printf("Applied migration %v in %v\n", result.Source.Version, result.Duration)
+	}
+	return err
+}
+
+// store which keeps the books in a sql database
+// placeholders are rebound for the driver, so any driver known to sqlx works
+type SQLStore struct {
+	db *sqlx.DB
+}
+
+// open database and migrate it to the latest version
+// driver is a database/sql driver name, "postgres" is registered by lib/pq
+func OpenSQLStore(driver string, dsn string) (*SQLStore, error) {
+	db, err := sqlx.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	dialect := driver
+	if driver == "sqlite" {
+		dialect = "sqlite3"
+	}
+	if err := migrateDB(db.DB, dialect); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return NewSQLStore(db), nil
+}
+
+// create store for already migrated database
+func NewSQLStore(db *sqlx.DB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+// Close the database
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+// List all the books in the database
+func (s *SQLStore) List() ([]Book, error) {
+	var rows []bookRow
+	err := s.db.Select(&rows, "SELECT "+bookColumns+" FROM books WHERE deleted_at IS NULL ORDER BY position")
+	if err != nil {
+		return nil, err
+	}
+	return bookRows(rows), nil
+}
+
+// convert rows of the books table to books
+func bookRows(rows []bookRow) []Book {
+	books := make([]Book, 0, len(rows))
+	for _, row := range rows {
+		books = append(books, row.book())
+	}
+	return books
+}
+
+// Get book by id from the database
+func (s *SQLStore) Get(id string) (Book, error) {
+	book, err := getBookRow(s.db, id)
+	if err == nil && book.DeletedAt != nil {
+		return Book{}, ErrBookNotFound
+	}
+	return book, err
+}
+
+// get book by id with db or transaction
+func getBookRow(q sqlx.Ext, id string) (Book, error) {
+	var row bookRow
+	err := sqlx.Get(q, &row, q.Rebind("SELECT "+bookColumns+" FROM books WHERE id = ?"), id)
+	if err == sql.ErrNoRows {
+		return Book{}, ErrBookNotFound
+	}
+	return row.book(), err
+}
+
+// Add books to the end of the table in one transaction
+func (s *SQLStore) Add(newBooks ...Book) error {
+	return s.insertBooks(newBooks, checkNewBooks)
+}
+
+// Import books as they are, with their version and deleted_at, e.g. from an old books.json
+// nothing is imported when any of the books already exists
+func (s *SQLStore) Import(books ...Book) error {
+	return s.insertBooks(books, checkImportedBooks)
+}
+
+// insert books after the last position once check accepts them
+func (s *SQLStore) insertBooks(newBooks []Book, check func(books []Book, newBooks []Book) error) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	position, err := reservePositions(tx, len(newBooks))
+	if err != nil {
+		return err
+	}
+	stored, err := storedBooks(tx, newBooks)
+	if err != nil {
+		return err
+	}
+	if err := check(stored, newBooks); err != nil {
+		return err
+	}
+
+	for _, book := range newBooks {
+		position++
+		if err := insertBookRow(tx, position, book); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Upsert books of the database in one transaction
+func (s *SQLStore) Upsert(newBooks ...Book) ([]BookChange, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	position, err := reservePositions(tx, len(newBooks))
+	if err != nil {
+		return nil, err
+	}
+	stored, err := storedBooks(tx, newBooks)
+	if err != nil {
+		return nil, err
+	}
+	_, changes, err := upsertBooks(stored, newBooks)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, change := range changes {
+		if change.Before == nil {
+			position++
+			err = insertBookRow(tx, position, change.After)
+		} else {
+			err = updateBookRow(tx, change.After, change.Before.Version)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return changes, tx.Commit()
+}
+
+// reserve n positions after the last one, returns the position before them
+// the update locks the counter row until commit, so concurrent adds wait here
+// and then see the books added before them
+func reservePositions(tx *sqlx.Tx, n int) (int64, error) {
+	var position int64
+	_, err := tx.Exec(tx.Rebind("UPDATE book_positions SET position = position + ? WHERE id = 1"), n)
+	if err == nil {
+		err = tx.Get(&position, "SELECT position FROM book_positions WHERE id = 1")
+	}
+	return position - int64(n), err
+}
+
+// stored books with the ids of the given ones, in trash or not
+func storedBooks(tx *sqlx.Tx, books []Book) ([]Book, error) {
+	var stored []Book
+	for _, book := range books {
+		if _, _, err := getBookById(stored, book.Id); err == nil {
+			continue
+		}
+		storedBook, err := getBookRow(tx, book.Id)
+		if err == nil {
+			stored = append(stored, storedBook)
+		} else if err != ErrBookNotFound {
+			return nil, err
+		}
+	}
+	return stored, nil
+}
+
+// insert book at the given position
+func insertBookRow(tx *sqlx.Tx, position int64, book Book) error {
+	values := append([]interface{}{position, book.Id, book.Title, book.Author, book.Price.Amount, book.Price.Currency, book.Imageurl, book.Version, book.DeletedAt},
+		coverValues(book.Cover)...)
+	_, err := tx.Exec(tx.Rebind("INSERT INTO books (position, "+bookColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"), values...)
+	return err
+}
+
+// write the fields and version of the book if it is still at the given version
+func updateBookRow(tx *sqlx.Tx, book Book, version int64) error {
+	// version in WHERE guards against a concurrent update of the same row
+	values := append([]interface{}{book.Title, book.Author, book.Price.Amount, book.Price.Currency, book.Imageurl, book.Version},
+		coverValues(book.Cover)...)
+	result, err := tx.Exec(tx.Rebind("UPDATE books SET title = ?, author = ?, price_amount = ?, price_currency = ?, image_url = ?, version = ?, "+
+		"cover_url = ?, cover_content_type = ?, cover_size = ?, cover_width = ?, cover_height = ?, cover_thumbnail_width = ?, cover_thumbnail_height = ? "+
+		"WHERE id = ? AND version = ?"), append(values, book.Id, version)...)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		if err == nil {
+			err = fmt.Errorf("%w: %s was updated concurrently", ErrVersionMismatch, book.Id)
+		}
+		return err
+	}
+	return nil
+}
+
+// Update the book with the same id in the database
+func (s *SQLStore) Update(book Book) (BookChange, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return BookChange{}, err
+	}
+	defer tx.Rollback()
+
+	stored, err := getBookRow(tx, book.Id)
+	if err != nil {
+		return BookChange{}, err
+	}
+	change, err := updateBook([]Book{stored}, book)
+	if err != nil {
+		return BookChange{}, err
+	}
+	if err := updateBookRow(tx, change.After, stored.Version); err != nil {
+		return BookChange{}, err
+	}
+	return change, tx.Commit()
+}
+
+// Delete book by id from the database, the book is moved to trash
+func (s *SQLStore) Delete(id string, version int64) (BookChange, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return BookChange{}, err
+	}
+	defer tx.Rollback()
+
+	stored, err := getBookRow(tx, id)
+	if err != nil {
+		return BookChange{}, err
+	}
+	change, err := deleteBook([]Book{stored}, id, version, time.Now().UTC())
+	if err != nil {
+		return BookChange{}, err
+	}
+	if err := setDeletedAt(tx, change.After, stored.Version); err != nil {
+		return BookChange{}, err
+	}
+	return change, tx.Commit()
+}
+
+// write deleted_at and version of the book if it is still at the given version
+func setDeletedAt(tx *sqlx.Tx, book Book, version int64) error {
+	result, err := tx.Exec(tx.Rebind("UPDATE books SET deleted_at = ?, version = ? WHERE id = ? AND version = ?"),
+		book.DeletedAt, book.Version, book.Id, version)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		if err == nil {
+			err = fmt.Errorf("%w: %s was updated concurrently", ErrVersionMismatch, book.Id)
+		}
+		return err
+	}
+	return nil
+}
+
+// List the books in trash of the database
+func (s *SQLStore) Trash() ([]Book, error) {
+	var rows []bookRow
+	err := s.db.Select(&rows, "SELECT "+bookColumns+" FROM books WHERE deleted_at IS NOT NULL ORDER BY position")
+	if err != nil {
+		return nil, err
+	}
+	return bookRows(rows), nil
+}
+
+// Restore book from trash of the database
+func (s *SQLStore) Restore(id string) (BookChange, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return BookChange{}, err
+	}
+	defer tx.Rollback()
+
+	stored, err := getBookRow(tx, id)
+	if err != nil {
+		return BookChange{}, err
+	}
+	change, err := restoreBook([]Book{stored}, id)
+	if err != nil {
+		return BookChange{}, err
+	}
+	if err := setDeletedAt(tx, change.After, stored.Version); err != nil {
+		return BookChange{}, err
+	}
+	return change, tx.Commit()
+}
+
+// Purge books deleted before the given time from the database
+// RETURNING gives the deleted rows of the same statement, postgres and sqlite support it
+func (s *SQLStore) Purge(deletedBefore time.Time) ([]Book, error) {
+	var rows []bookRow
+	err := s.db.Select(&rows, s.db.Rebind("DELETE FROM books WHERE deleted_at IS NOT NULL AND deleted_at < ? RETURNING "+bookColumns), deletedBefore.UTC())
+	if err != nil {
+		return nil, err
+	}
+	return bookRows(rows), nil
+}
+
+// remove books which are in trash longer than retention
+func purgeTrash(store BookStore, retention time.Duration) (int, error) {
+	purged, err := storeAs(store, "purge").Purge(time.Now().Add(-retention))
+	if len(purged) > 0 {
+		log.Printf("Purged %v books from trash\n", len(purged))
+	}
+	return len(purged), err
+}
+
+// run purgeTrash every interval until stop is closed
+func startPurgeJob(store BookStore, retention time.Duration, interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			_, err := purgeTrash(store, retention)
+			checkError(err)
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// store which can take books with their version and trash state, like SQLStore
+type BookImporter interface {
+	Import(books ...Book) error
+}
+
+// copy all the books of a json file into the store, e.g. to fill a new database
+// books in trash stay in trash, nothing is imported when any of the books already exists
+func importBooks(store BookImporter, path string) (int, error) {
+	books, err := getBooks(path)
+	if err != nil {
+		return 0, err
+	}
+	if err := store.Import(books...); err != nil {
+		return 0, err
+	}
+	return len(books), nil
+}
+
+// open the store of -db driver:dsn, e.g. "postgres:postgres://localhost/books",
+// or the json file when db is empty
+func openBookStore(dataFile string, db string) (BookStore, error) {
+	if db == "" {
+		return NewJSONFileStore(dataFile)
+	}
+	i := strings.IndexByte(db, ':')
+	if i < 1 {
+		return nil, fmt.Errorf("db %q must be driver:dsn", db)
+	}
+	return OpenSQLStore(db[:i], db[i+1:])
+}
+
+// close stores holding a connection, like SQLStore
+func closeBookStore(store BookStore) {
+	if closer, ok := store.(io.Closer); ok {
+		checkError(closer.Close())
+	}
+}
+
+// file extensions of the supported cover types
+var coverExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// local directory of cover images named by the sha256 of their content
+type CoverStore struct {
+	dir string
+}
+
+// use dir for the covers, it is created when missing
+func NewCoverStore(dir string) (*CoverStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &CoverStore{dir}, nil
+}
+
+// Save image unless the same image is already stored and describe it
+func (c *CoverStore) Save(data []byte) (Cover, error) {
+	contentType := http.DetectContentType(data)
+	extension, ok := coverExtensions[contentType]
+	if !ok {
+		return Cover{}, ErrInvalidCover
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width < 1 || config.Height < 1 {
+		return Cover{}, fmt.Errorf("%w: %v", ErrInvalidCover, err)
+	}
+
+	sum := sha256.Sum256(data)
+	name := hex.EncodeToString(sum[:]) + extension
+	path := filepath.Join(c.dir, name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := writeCoverFile(path, data); err != nil {
+			return Cover{}, err
+		}
+	} else if err != nil {
+		return Cover{}, err
+	}
+
+	thumbnailWidth, thumbnailHeight := thumbnailSize(config.Width, config.Height, THUMBNAIL_SIZE)
+	return Cover{"/covers/" + name, contentType, int64(len(data)), config.Width, config.Height, thumbnailWidth, thumbnailHeight}, nil
+}
+
+// Path of the cover file, false for names which are not stored covers
+func (c *CoverStore) Path(name string) (string, bool) {
+	extension := filepath.Ext(name)
+	hash := strings.TrimSuffix(name, extension)
+	if len(hash) != sha256.Size*2 || strings.Trim(hash, "0123456789abcdef") != "" {
+		return "", false
+	}
+	known := false
+	for _, coverExtension := range coverExtensions {
+		known = known || extension == coverExtension
+	}
+	path := filepath.Join(c.dir, name)
+	if _, err := os.Stat(path); !known || err != nil {
+		return "", false
+	}
+	return path, true
+}
+
+// write the image through a temp file, so a cover is never served half written
+func writeCoverFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".cover-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// scale width and height down to fit into a square of size, keeping the aspect ratio
+// images already smaller than the square keep their size
+func thumbnailSize(width int, height int, size int) (int, int) {
+	if width <= size && height <= size {
+		return width, height
+	}
+	if width >= height {
+		return size, atLeastOne(height * size / width)
+	}
+	return atLeastOne(width * size / height), size
+}
+
+// very thin images still get one pixel
+func atLeastOne(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// book found by search with its relevance, higher is better
+type SearchHit struct {
+	Book  Book    `json:"book"`
+	Score float64 `json:"score"`
+}
+
+// result of GET /books/search
+type SearchResult struct {
+	Query string      `json:"query"`
+	Total int         `json:"total"`
+	Hits  []SearchHit `json:"hits"`
+}
+
+// stores which can search the catalog themselves
+type BookSearcher interface {
+	Search(query string, limit int) ([]SearchHit, error)
+}
+
+// weights of the searchable fields
+const (
+	TITLE_WEIGHT  float64 = 2
+	AUTHOR_WEIGHT float64 = 1
+	// weight of a query term matching only the beginning of a word
+	PREFIX_WEIGHT float64 = 0.5
+)
+
+// letters which do not decompose into a base letter and an accent
+var foldReplacer = strings.NewReplacer("ß", "ss", "æ", "ae", "œ", "oe", "ø", "o", "ł", "l", "đ", "d", "ð", "d", "þ", "th", "ı", "i")
+
+// split text into lower case words without accents, "Égalité" gives "egalite"
+func tokenize(text string) []string {
+	decomposed := norm.NFD.String(strings.ToLower(text))
+	var folded strings.Builder
+	for _, c := range decomposed {
+		if !unicode.Is(unicode.Mn, c) {
+			folded.WriteRune(c)
+		}
+	}
+	return strings.FieldsFunc(foldReplacer.Replace(folded.String()), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+}
+
+// in-process inverted index over title and author of the books
+type SearchIndex struct {
+	mu sync.RWMutex
+	// term -> book id -> weighted term frequency
+	postings map[string]map[string]float64
+	// indexed books and their terms, terms are needed to remove a book
+	books map[string]Book
+	terms map[string][]string
+	// sorted terms for prefix matching
+	sortedTerms []string
+}
+
+// create index of the given books
+func NewSearchIndex(books []Book) *SearchIndex {
+	index := &SearchIndex{}
+	index.Rebuild(books)
+	return index
+}
+
+// replace all the indexed books
+func (index *SearchIndex) Rebuild(books []Book) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	index.postings = map[string]map[string]float64{}
+	index.books = map[string]Book{}
+	index.terms = map[string][]string{}
+	for _, book := range books {
+		index.put(book)
+	}
+	index.sortTerms()
+}
+
+// add or replace the book
+func (index *SearchIndex) Put(book Book) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	index.remove(book.Id)
+	index.put(book)
+	index.sortTerms()
+}
+
+// remove the book, unknown id is ignored
+func (index *SearchIndex) Remove(id string) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	index.remove(id)
+	index.sortTerms()
+}
+
+func (index *SearchIndex) put(book Book) {
+	frequencies := map[string]float64{}
+	for _, term := range tokenize(book.Title) {
+		frequencies[term] += TITLE_WEIGHT
+	}
+	for _, term := range tokenize(book.Author) {
+		frequencies[term] += AUTHOR_WEIGHT
+	}
+	terms := make([]string, 0, len(frequencies))
+	for term, frequency := range frequencies {
+		if index.postings[term] == nil {
+			index.postings[term] = map[string]float64{}
+		}
+		index.postings[term][book.Id] = frequency
+		terms = append(terms, term)
+	}
+	index.books[book.Id] = book
+	index.terms[book.Id] = terms
+}
+
+func (index *SearchIndex) remove(id string) {
+	for _, term := range index.terms[id] {
+		delete(index.postings[term], id)
+		if len(index.postings[term]) == 0 {
+			delete(index.postings, term)
+		}
+	}
+	delete(index.books, id)
+	delete(index.terms, id)
+}
+
+func (index *SearchIndex) sortTerms() {
+	index.sortedTerms = index.sortedTerms[:0]
+	for term := range index.postings {
+		index.sortedTerms = append(index.sortedTerms, term)
+	}
+	sort.Strings(index.sortedTerms)
+}
+
+// find books matching any of the query words, best matches first
+// words match whole terms, or the beginning of terms with a lower weight.
+// Score is tf-idf scaled by the share of query words the book matched
+func (index *SearchIndex) Search(query string, limit int) ([]SearchHit, error) {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	queryTerms := tokenize(query)
+	scores := map[string]float64{}
+	matched := map[string]int{}
+	for _, queryTerm := range queryTerms {
+		termScores := map[string]float64{}
+		// terms starting with the query term follow it in sorted order
+		start := sort.SearchStrings(index.sortedTerms, queryTerm)
+		for _, term := range index.sortedTerms[start:] {
+			if !strings.HasPrefix(term, queryTerm) {
+				break
+			}
+			weight := 1.0
+			if term != queryTerm {
+				weight = PREFIX_WEIGHT
+			}
+			idf := math.Log(1 + float64(len(index.books))/float64(len(index.postings[term])))
+			for id, frequency := range index.postings[term] {
+				if score := weight * frequency * idf; score > termScores[id] {
+					termScores[id] = score
+				}
+			}
+		}
+		for id, score := range termScores {
+			scores[id] += score
+			matched[id]++
+		}
+	}
+
+	hits := []SearchHit{}
+	for id, score := range scores {
+		score *= float64(matched[id]) / float64(len(queryTerms))
+		hits = append(hits, SearchHit{index.books[id], math.Round(score*1000) / 1000})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Book.Id < hits[j].Book.Id
+	})
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits, nil
+}
+
+// store which keeps a search index of the wrapped store in sync
+// the index is built from the store on creation and updated after every
+// successful change made through this store
+// changes hold mu from the store write until the index is updated, so the
+// index sees them in the order the store made them
+type IndexedStore struct {
+	BookStore
+	mu    sync.Mutex
+	index *SearchIndex
+}
+
+// wrap store and index all of its books
+func NewIndexedStore(store BookStore) (*IndexedStore, error) {
+	books, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	return &IndexedStore{BookStore: store, index: NewSearchIndex(books)}, nil
+}
+
+// Add books to the store and the index
+func (s *IndexedStore) Add(newBooks ...Book) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.BookStore.Add(newBooks...)
+	if err == nil {
+		for _, book := range newBooks {
+			book.Version = 1
+			s.index.Put(book)
+		}
+	}
+	return err
+}
+
+// Upsert books in the store and the index
+func (s *IndexedStore) Upsert(newBooks ...Book) ([]BookChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changes, err := s.BookStore.Upsert(newBooks...)
+	for _, change := range changes {
+		s.index.Put(change.After)
+	}
+	return changes, err
+}
+
+// Update the book in the store and the index
+func (s *IndexedStore) Update(book Book) (BookChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	change, err := s.BookStore.Update(book)
+	if err == nil {
+		s.index.Put(change.After)
+	}
+	return change, err
+}
+
+// Delete book from the index when it is moved to trash
+func (s *IndexedStore) Delete(id string, version int64) (BookChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	change, err := s.BookStore.Delete(id, version)
+	if err == nil {
+		s.index.Remove(id)
+	}
+	return change, err
+}
+
+// Restore book and index it again
+func (s *IndexedStore) Restore(id string) (BookChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	change, err := s.BookStore.Restore(id)
+	if err == nil {
+		s.index.Put(change.After)
+	}
+	return change, err
+}
+
+// Search the books of the index
+func (s *IndexedStore) Search(query string, limit int) ([]SearchHit, error) {
+	return s.index.Search(query, limit)
+}
+
+// search store with its own index or through a temporary one
+func searchBooks(store BookStore, query string, limit int) ([]SearchHit, error) {
+	if searcher, ok := store.(BookSearcher); ok {
+		return searcher.Search(query, limit)
+	}
+	books, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	return NewSearchIndex(books).Search(query, limit)
+}
+
+// operations of the audit log
+const (
+	AUDIT_CREATE  = "create"
+	AUDIT_UPDATE  = "update"
+	AUDIT_DELETE  = "delete"
+	AUDIT_RESTORE = "restore"
+	AUDIT_PURGE   = "purge"
+)
+
+// one change of a book, before is null for create and after for purge
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Operation string    `json:"operation"`
+	BookId    string    `json:"book_id"`
+	Before    *Book     `json:"before"`
+	After     *Book     `json:"after"`
+}
+
+// append-only log of the catalog changes
+type AuditLog interface {
+	Append(entries ...AuditEntry) error
+	// changes of one book, oldest first
+	History(id string) ([]AuditEntry, error)
+}
+
+// stores which know the history of the books
+type BookHistory interface {
+	History(id string) ([]AuditEntry, error)
+}
+
+// stores which record who made the changes
+type ActorStore interface {
+	As(actor string) BookStore
+}
+
+// audit log which keeps the entries in memory
+type MemoryAuditLog struct {
+	mu      sync.RWMutex
+	entries []AuditEntry
+}
+
+// create empty audit log in memory
+func NewMemoryAuditLog() *MemoryAuditLog {
+	return &MemoryAuditLog{}
+}
+
+// Append entries to the end of the log
+func (l *MemoryAuditLog) Append(entries ...AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, entries...)
+	return nil
+}
+
+// History of the book from memory
+func (l *MemoryAuditLog) History(id string) ([]AuditEntry, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	history := []AuditEntry{}
+	for _, entry := range l.entries {
+		if entry.BookId == id {
+			history = append(history, entry)
+		}
+	}
+	return history, nil
+}
+
+// audit log which appends one json entry per line to a file
+type FileAuditLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+// use file as audit log, it is created by the first change
+func NewFileAuditLog(path string) *FileAuditLog {
+	return &FileAuditLog{path: path}
+}
+
+// Append entries to the end of the file, existing lines are never rewritten
+func (l *FileAuditLog) Append(entries ...AuditEntry) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// History of the book from the file, missing file has no history
+func (l *FileAuditLog) History(id string) ([]AuditEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	history := []AuditEntry{}
+	file, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return history, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", l.path, line, err)
+		}
+		if entry.BookId == id {
+			history = append(history, entry)
+		}
+	}
+	return history, scanner.Err()
+}
+
+// store which writes every successful change of the wrapped store to an audit log
+// wrap the other stores with it, so it can see the changes made through them
+// changes hold mu from the store write until their entries are appended, so the
+// log has them in the order the store made them, mu is shared with the As stores
+type AuditedStore struct {
+	BookStore
+	log   AuditLog
+	actor string
+	mu    *sync.Mutex
+}
+
+// record changes of the store to the log, actor of the changes is set with As
+func NewAuditedStore(store BookStore, log AuditLog) *AuditedStore {
+	return &AuditedStore{store, log, "unknown", &sync.Mutex{}}
+}
+
+// As returns the store recording changes made by actor
+func (s *AuditedStore) As(actor string) BookStore {
+	actorStore := *s
+	actorStore.actor = actor
+	return &actorStore
+}
+
+// History of the book from the audit log
+func (s *AuditedStore) History(id string) ([]AuditEntry, error) {
+	return s.log.History(id)
+}
+
+// Search the wrapped store
+func (s *AuditedStore) Search(query string, limit int) ([]SearchHit, error) {
+	return searchBooks(s.BookStore, query, limit)
+}
+
+// Add books and record their creation
+func (s *AuditedStore) Add(newBooks ...Book) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.BookStore.Add(newBooks...); err != nil {
+		return err
+	}
+	entries := []AuditEntry{}
+	for _, book := range newBooks {
+		book.Version = 1
+		book.DeletedAt = nil
+		entries = append(entries, s.entry(AUDIT_CREATE, book.Id, nil, &book))
+	}
+	s.append(entries...)
+	return nil
+}
+
+// Upsert books and record their creation or both versions
+func (s *AuditedStore) Upsert(newBooks ...Book) ([]BookChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changes, err := s.BookStore.Upsert(newBooks...)
+	if err != nil {
+		return nil, err
+	}
+	entries := []AuditEntry{}
+	for i := range changes {
+		if changes[i].Before == nil {
+			entries = append(entries, s.entry(AUDIT_CREATE, changes[i].After.Id, nil, &changes[i].After))
+		} else {
+			entries = append(entries, s.entry(AUDIT_UPDATE, changes[i].After.Id, changes[i].Before, &changes[i].After))
+		}
+	}
+	s.append(entries...)
+	return changes, nil
+}
+
+// Update the book and record both versions
+func (s *AuditedStore) Update(book Book) (BookChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	change, err := s.BookStore.Update(book)
+	if err != nil {
+		return BookChange{}, err
+	}
+	s.append(s.entry(AUDIT_UPDATE, book.Id, change.Before, &change.After))
+	return change, nil
+}
+
+// Delete the book and record it as moved to trash
+func (s *AuditedStore) Delete(id string, version int64) (BookChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	change, err := s.BookStore.Delete(id, version)
+	if err != nil {
+		return BookChange{}, err
+	}
+	s.append(s.entry(AUDIT_DELETE, id, change.Before, &change.After))
+	return change, nil
+}
+
+// Restore the book and record it as taken out of trash
+func (s *AuditedStore) Restore(id string) (BookChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	change, err := s.BookStore.Restore(id)
+	if err != nil {
+		return BookChange{}, err
+	}
+	s.append(s.entry(AUDIT_RESTORE, id, change.Before, &change.After))
+	return change, nil
+}
+
+// Purge the trash and record every removed book
+func (s *AuditedStore) Purge(deletedBefore time.Time) ([]Book, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	purged, err := s.BookStore.Purge(deletedBefore)
+	if err != nil {
+		return nil, err
+	}
+	entries := []AuditEntry{}
+	for i := range purged {
+		entries = append(entries, s.entry(AUDIT_PURGE, purged[i].Id, &purged[i], nil))
+	}
+	s.append(entries...)
+	return purged, nil
+}
+
+func (s *AuditedStore) entry(operation string, id string, before *Book, after *Book) AuditEntry {
+	return AuditEntry{time.Now().UTC(), s.actor, operation, id, before, after}
+}
+
+// the change is already made, so a failed write is only logged
+func (s *AuditedStore) append(entries ...AuditEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	if err := s.log.Append(entries...); err != nil {
+		log.Printf("Audit Error %v\n", err)
+	}
+}
+
+type actorKey struct{}
+
+// request made by actor, e.g. the authenticated user
+func withActor(r *http.Request, actor string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), actorKey{}, actor))
+}
+
+// actor of the request, the client address when nobody is set
+func requestActor(r *http.Request) string {
+	if actor, ok := r.Context().Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// store recording changes made by actor when it records them at all
+func storeAs(store BookStore, actor string) BookStore {
+	if actorStore, ok := store.(ActorStore); ok {
+		return actorStore.As(actor)
+	}
+	return store
+}
+
+// store recording changes made by the actor of the request
+func actingAs(store BookStore, r *http.Request) BookStore {
+	return storeAs(store, requestActor(r))
+}
+
+// how long responses are replayed for retries with the same Idempotency-Key
+const IDEMPOTENCY_WINDOW time.Duration = 24 * time.Hour
+
+// longest accepted Idempotency-Key
+const MAX_IDEMPOTENCY_KEY int = 255
+
+// first response to a request with an Idempotency-Key
+type idempotentResponse struct {
+	fingerprint [sha256.Size]byte
+	// false while the first request is still handled
+	done    bool
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// responses of requests with an Idempotency-Key, kept in memory for window
+type IdempotencyCache struct {
+	mu        sync.Mutex
+	window    time.Duration
+	responses map[string]*idempotentResponse
+}
+
+// create cache which replays responses for window
+func NewIdempotencyCache(window time.Duration) *IdempotencyCache {
+	return &IdempotencyCache{window: window, responses: map[string]*idempotentResponse{}}
+}
+
+// start request with key, returns the stored response when the key is known
+// a new key is reserved until Finish or Abort is called
+func (c *IdempotencyCache) Start(key string, fingerprint [sha256.Size]byte) (*idempotentResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, response := range c.responses {
+		if response.done && now.After(response.expires) {
+			delete(c.responses, k)
+		}
+	}
+	if response, ok := c.responses[key]; ok {
+		stored := *response
+		return &stored, true
+	}
+	c.responses[key] = &idempotentResponse{fingerprint: fingerprint}
+	return nil, false
+}
+
+// Finish request with key and keep its response for the window
+func (c *IdempotencyCache) Finish(key string, status int, header http.Header, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if response, ok := c.responses[key]; ok {
+		response.done = true
+		response.status = status
+		response.header = header
+		response.body = body
+		response.expires = time.Now().Add(c.window)
+	}
+}
+
+// Abort request with key, so it can be retried
+func (c *IdempotencyCache) Abort(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.responses, key)
+}
+
+// response writer which keeps a copy of the response
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+// middleware which replays the first response to retries with the same Idempotency-Key
+// keys are scoped to the actor, a retry with another body gets 422 and
+// a retry while the first request is still handled gets 409.
+// Server errors are not kept, so the request can be retried
+func idempotent(cache *IdempotencyCache, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			handler(w, r)
+			return
+		}
+		if len(key) > MAX_IDEMPOTENCY_KEY {
+			writeError(w, 400, CodeBadRequest, fmt.Sprintf("Idempotency-Key is longer than %d characters", MAX_IDEMPOTENCY_KEY))
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("Client Error %v\n", err)
+			writeError(w, 400, CodeBadRequest, "Bad Request")
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		fingerprint := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+
+		cacheKey := requestActor(r) + "\n" + key
+		stored, ok := cache.Start(cacheKey, fingerprint)
+		if ok && stored.fingerprint != fingerprint {
+			writeError(w, 422, CodeValidationFailed, "Idempotency-Key was used for another request")
+			return
+		}
+		if ok && !stored.done {
+			writeError(w, 409, CodeConflict, "Request with this Idempotency-Key is in progress")
+			return
+		}
+		if ok {
+			for name, values := range stored.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.status)
+			w.Write(stored.body)
+			return
+		}
+
+		recorder := &recordingWriter{ResponseWriter: w}
+		defer func() {
+			if recorder.status == 0 || recorder.status >= 500 {
+				cache.Abort(cacheKey)
+			} else {
+				cache.Finish(cacheKey, recorder.status, w.Header().Clone(), recorder.body.Bytes())
+			}
+		}()
+		handler(recorder, r)
+	}
+}
+
+// how often the keys and the revocation list of the issuer are fetched again,
+// a token revoked by logout is accepted at most this long
+const REVOCATION_REFRESH time.Duration = 30 * time.Second
+
+// tokens with a jti are rejected when the revocation list is older than this
+const REVOCATION_MAX_AGE time.Duration = 5 * time.Minute
+
+// claims of the tokens issued by the go-jwt service
+type TokenClaims struct {
+	UserName     string `json:"user_name"`
+	LoggedInTime string
+	jwt.RegisteredClaims
+}
+
+// returned when the request has no token or the token is not valid
+var ErrInvalidToken = errors.New("invalid token")
+
+// returned when the keys or the revocation list of the issuer can not be fetched
+var ErrIssuerUnavailable = errors.New("token issuer is not available")
+
+// fields of the discovery document of go-jwt used to verify its tokens
+type issuerDiscovery struct {
+	Issuer            string `json:"issuer"`
+	JWKSURI           string `json:"jwks_uri"`
+	RevocationListURI string `json:"revocation_list_uri"`
+}
+
+// fields of the JWKs (RFC 7517) of go-jwt needed to get the public key
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// token revoked before its expiry, entry of the revocation list of go-jwt
+type revokedToken struct {
+	ID      string    `json:"jti"`
+	Expires time.Time `json:"exp"`
+}
+
+// checks tokens of the go-jwt service running at Issuer, the same way its ParseJWT does
+// RS256, ES256 and EdDSA tokens are verified with the keys of the JWKS of the issuer,
+// HS256 tokens only when the shared secret is given. iss and aud must match and the
+// jti must not be on the revocation list of the issuer.
+// the JWKS and the list are found through the discovery document of the issuer.
+// They are fetched again every REVOCATION_REFRESH, and early when a token names an
+// unknown kid, at most once per MinRefresh
+type TokenVerifier struct {
+	Issuer     string
+	Audience   string
+	Client     *http.Client
+	MinRefresh time.Duration
+	secret     []byte
+
+	mu      sync.Mutex
+	keys    map[string]interface{}
+	revoked map[string]time.Time
+	// last fetch and last successful fetch of the issuer
+	fetched time.Time
+	updated time.Time
+	// closed when the running fetch is done, nil when none runs
+	fetching chan struct{}
+}
+
+// create verifier for the tokens of issuer for audience, the issuer when empty
+// secret verifies HS256 tokens, empty to accept only tokens of the JWKS
+func NewTokenVerifier(issuer string, audience string, secret string) *TokenVerifier {
+	if audience == "" {
+		audience = issuer
+	}
+	return &TokenVerifier{Issuer: issuer, Audience: audience, Client: &http.Client{Timeout: 10 * time.Second}, MinRefresh: 10 * time.Second, secret: []byte(secret)}
+}
+
+// Verify signature, expiry, issuer, audience and revocation of the token and return its claims
+func (v *TokenVerifier) Verify(tokenString string) (TokenClaims, error) {
+	methods := []string{"RS256", "ES256", "EdDSA"}
+	if len(v.secret) > 0 {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	var claims TokenClaims
+	token, err := jwt.ParseWithClaims(tokenString, &claims, v.lookup, jwt.WithValidMethods(methods))
+	if err != nil || !token.Valid {
+		if errors.Is(err, ErrIssuerUnavailable) {
+			return TokenClaims{}, err
+		}
+		return TokenClaims{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if !claims.VerifyIssuer(v.Issuer, true) || !claims.VerifyAudience(v.Audience, true) {
+		return TokenClaims{}, fmt.Errorf("%w: issued by %q for %q", ErrInvalidToken, claims.Issuer, claims.Audience)
+	}
+	if claims.UserName == "" {
+		claims.UserName = claims.Subject
+	}
+	if claims.UserName == "" {
+		return TokenClaims{}, fmt.Errorf("%w: no user name", ErrInvalidToken)
+	}
+	if err := v.checkRevoked(claims.ID); err != nil {
+		return TokenClaims{}, err
+	}
+	return claims, nil
+}
+
+// jwt.Keyfunc returning the shared secret for HS256 tokens and the key
+// of the JWKS named by the kid header for the others, jwt rejects the
+// key when its type does not match the signing method of the token
+func (v *TokenVerifier) lookup(token *jwt.Token) (interface{}, error) {
+	if token.Method == jwt.SigningMethodHS256 {
+		return v.secret, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	v.mu.Lock()
+	_, ok := v.keys[kid]
+	refresh := time.Since(v.fetched) > REVOCATION_REFRESH || (!ok && (v.fetching != nil || time.Since(v.fetched) > v.MinRefresh))
+	v.mu.Unlock()
+	if refresh {
+		v.refresh()
+	}
+	v.mu.Lock()
+	key, ok := v.keys[kid]
+	unavailable := time.Since(v.updated) > REVOCATION_MAX_AGE
+	v.mu.Unlock()
+	if !ok && unavailable {
+		return nil, fmt.Errorf("%w: no keys of %v", ErrIssuerUnavailable, v.Issuer)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// error when jti is on the revocation list, or when the list is too old to tell
+// tokens without jti can not be revoked
+func (v *TokenVerifier) checkRevoked(jti string) error {
+	if jti == "" {
+		return nil
+	}
+	v.mu.Lock()
+	refresh := time.Since(v.fetched) > REVOCATION_REFRESH
+	v.mu.Unlock()
+	if refresh {
+		v.refresh()
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if time.Since(v.updated) > REVOCATION_MAX_AGE {
+		return fmt.Errorf("%w: no revocation list of %v since %v", ErrIssuerUnavailable, v.Issuer, v.updated)
+	}
+	if expires, ok := v.revoked[jti]; ok && time.Now().Before(expires) {
+		return fmt.Errorf("%w: %v is revoked", ErrInvalidToken, jti)
+	}
+	return nil
+}
+
+// fetch the keys and the revocation list without holding the lock, callers
+// arriving while a fetch runs wait for it instead of starting their own
+func (v *TokenVerifier) refresh() {
+	v.mu.Lock()
+	if done := v.fetching; done != nil {
+		v.mu.Unlock()
+		<-done
+		return
+	}
+	done := make(chan struct{})
+	v.fetching = done
+	v.fetched = time.Now()
+	v.mu.Unlock()
+
+	keys, revoked, err := v.fetchIssuer()
+
+	v.mu.Lock()
+	if err != nil {
+		// keep using the cached keys and list while the issuer can not be reached
+		log.Printf("Auth Error %v\n", err)
+	} else {
+		v.keys, v.revoked, v.updated = keys, revoked, time.Now()
+	}
+	v.fetching = nil
+	v.mu.Unlock()
+	close(done)
+}
+
+// get the keys and the revoked tokens of the issuer through its discovery document
+// keys which can not be used are skipped
+func (v *TokenVerifier) fetchIssuer() (map[string]interface{}, map[string]time.Time, error) {
+	issuer := strings.TrimSuffix(v.Issuer, "/")
+	var discovery issuerDiscovery
+	if err := v.getJSON(issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != issuer {
+		return nil, nil, fmt.Errorf("discovery document is for issuer %q, not %q", discovery.Issuer, v.Issuer)
+	}
+	if discovery.JWKSURI == "" || discovery.RevocationListURI == "" {
+		return nil, nil, errors.New("discovery document has no jwks_uri or revocation_list_uri")
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := v.getJSON(discovery.JWKSURI, &jwks); err != nil {
+		return nil, nil, err
+	}
+	keys := map[string]interface{}{}
+	for _, jwk := range jwks.Keys {
+		key, err := jwk.public()
+		if err != nil {
+			log.Printf("Auth Error key %q: %v\n", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	var list struct {
+		Revoked []revokedToken `json:"revoked"`
+	}
+	if err := v.getJSON(discovery.RevocationListURI, &list); err != nil {
+		return nil, nil, err
+	}
+	revoked := map[string]time.Time{}
+	for _, token := range list.Revoked {
+		revoked[token.ID] = token.Expires
+	}
+	return keys, revoked, nil
+}
+
+func (v *TokenVerifier) getJSON(url string, target interface{}) error {
+	response, err := v.Client.Get(url)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrIssuerUnavailable, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return fmt.Errorf("%w: GET %s: %s", ErrIssuerUnavailable, url, response.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(target); err != nil {
+		return fmt.Errorf("%w: GET %s: %v", ErrIssuerUnavailable, url, err)
+	}
+	return nil
+}
+
+// public key of the JWK, RSA, P-256 and Ed25519 keys are supported
+func (k jwk) public() (interface{}, error) {
+	var err error
+	decode := func(value string) []byte {
+		decoded, decodeErr := base64.RawURLEncoding.DecodeString(value)
+		if decodeErr != nil {
+			err = decodeErr
+		}
+		return decoded
+	}
+	switch {
+	case k.Kty == "RSA":
+		n, e := new(big.Int).SetBytes(decode(k.N)), new(big.Int).SetBytes(decode(k.E))
+		if err == nil && (e.Sign() == 0 || e.BitLen() > 31) {
+			err = errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, err
+	case k.Kty == "EC" && k.Crv == "P-256":
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(decode(k.X)), Y: new(big.Int).SetBytes(decode(k.Y))}
+		if err == nil && !key.Curve.IsOnCurve(key.X, key.Y) {
+			err = errors.New("not on P-256")
+		}
+		return key, err
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		x := decode(k.X)
+		if err == nil && len(x) != ed25519.PublicKeySize {
+			err = errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), err
+	}
+	return nil, fmt.Errorf("unsupported key type %s %s", k.Kty, k.Crv)
+}
+
+// token of the request from Authorization: Bearer or from the Token header used by go-jwt
+func requestToken(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+	return r.Header.Get("Token")
+}
+
+// middleware which lets only requests with a valid token through
+// the user name of the token is the actor of the changes made by handler
+func requireToken(verifier *TokenVerifier, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := requestToken(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="bookstore"`)
+			writeError(w, 401, CodeUnauthorized, "Please provide valid JWT token in request header as Token")
+			return
+		}
+		claims, err := verifier.Verify(token)
+		if errors.Is(err, ErrIssuerUnavailable) {
+			log.Printf("Auth Error %v\n", err)
+			writeError(w, 503, CodeUnavailable, "Token can not be checked now, try again later")
+			return
+		}
+		if err != nil {
+			log.Printf("Auth Error %v\n", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="bookstore", error="invalid_token"`)
+			writeError(w, 401, CodeUnauthorized, "You are not authorized to change the books")
+			return
+		}
+		handler(w, withActor(r, claims.UserName))
+	}
+}
+
+// content types of the catalog formats
+var catalogContentTypes = map[string]string{
+	"csv":    "text/csv",
+	"ndjson": "application/x-ndjson",
+}
+
+// columns of the csv catalog, price is the decimal amount
+var catalogColumns = []string{"id", "title", "author", "price", "currency", "image_url", "version"}
+
+// catalog format for content type, empty when unknown
+func catalogFormat(contentType string) string {
+	mediaType := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	for format, formatType := range catalogContentTypes {
+		if mediaType == formatType {
+			return format
+		}
+	}
+	return ""
+}
+
+// spreadsheets run csv cells starting with one of these as formulas
+const csvFormulaStart = "=+-@\t\r"
+
+// whether the cell, without its leading quotes, would be run as a formula
+func csvFormula(cell string) bool {
+	cell = strings.TrimLeft(cell, "'")
+	return cell != "" && strings.ContainsRune(csvFormulaStart, rune(cell[0]))
+}
+
+// prefix text which a spreadsheet would run as a formula with a quote,
+// which keeps it text, readCatalogCSV removes the quote again
+func escapeCSV(cell string) string {
+	if csvFormula(cell) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// remove the quote added by escapeCSV
+func unescapeCSV(cell string) string {
+	if strings.HasPrefix(cell, "'") && csvFormula(cell) {
+		return cell[1:]
+	}
+	return cell
+}
+
+// write books as csv with a header row or as one json book per line
+// text cells are escaped against formula injection with escapeCSV
+func writeCatalog(w io.Writer, format string, books []Book) error {
+	if format == "ndjson" {
+		encoder := json.NewEncoder(w)
+		for _, book := range books {
+			if err := encoder.Encode(book); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Write(catalogColumns)
+	for _, book := range books {
+		csvWriter.Write([]string{escapeCSV(book.Id), escapeCSV(book.Title), escapeCSV(book.Author), book.Price.AmountString(), book.Price.Currency, escapeCSV(book.Imageurl), strconv.FormatInt(book.Version, 10)})
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// read books from csv or ndjson, invalid rows are returned with their errors
+// error is returned only when the file itself can not be read
+func readCatalog(r io.Reader, format string) ([]importRow, error) {
+	if format == "ndjson" {
+		return readCatalogNDJSON(r)
+	}
+	return readCatalogCSV(r)
+}
+
+// read one json book per line, blank lines are skipped
+func readCatalogNDJSON(r io.Reader) ([]importRow, error) {
+	var rows []importRow
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		row := importRow{Row: line}
+		if err := json.Unmarshal(scanner.Bytes(), &row.Book); err != nil {
+			if errors.Is(err, ErrInvalidPrice) {
+				row.Errors = []FieldError{{"price", err.Error()}}
+			} else {
+				row.Errors = []FieldError{{"", "line must be a json book"}}
+			}
+		} else {
+			row.Errors = validateBook(row.Book, "")
+		}
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+// read csv with a header row naming the columns, currency and image_url are optional
+// cells escaped by writeCatalog are read back unescaped
+func readCatalogCSV(r io.Reader) ([]importRow, error) {
+	csvReader := csv.NewReader(r)
+	csvReader.FieldsPerRecord = -1
+	header, err := csvReader.Read()
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"id", "title", "author", "price"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("csv header has no %s column", name)
+		}
+	}
+
+	var rows []importRow
+	for line := 2; ; line++ {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		value := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return unescapeCSV(strings.TrimSpace(record[i]))
+			}
+			return ""
+		}
+
+		row := importRow{Row: line, Book: Book{Id: value("id"), Title: value("title"), Author: value("author"), Imageurl: value("image_url")}}
+		if price := value("price"); price != "" {
+			if currency := value("currency"); currency != "" {
+				price += " " + currency
+			}
+			row.Book.Price, err = ParseMoney(price)
+			if err != nil {
+				row.Errors = append(row.Errors, FieldError{"price", err.Error()})
+			}
+		}
+		for _, fieldErr := range validateBook(row.Book, "") {
+			// invalid price is already reported above
+			if fieldErr.Field != "price" || len(row.Errors) == 0 {
+				row.Errors = append(row.Errors, fieldErr)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// add valid rows to the store with one Add, or with one Upsert which also replaces existing books
+// rows of books in trash, and of existing books without upsert, are reported as failed
+func importCatalog(store BookStore, rows []importRow, upsert bool) ImportResult {
+	result := ImportResult{Errors: []ImportError{}}
+	fail := func(row importRow, msg string, fields []FieldError) {
+		result.Failed++
+		result.Errors = append(result.Errors, ImportError{row.Row, msg, fields})
+	}
+
+	books, err := store.List()
+	var trash []Book
+	if err == nil {
+		trash, err = store.Trash()
+	}
+	if err != nil {
+		log.Printf("Server Error %v\n", err)
+	}
+
+	var batch []importRow
+	var batchBooks []Book
+	for _, row := range rows {
+		if len(row.Errors) > 0 {
+			fail(row, "Invalid book", row.Errors)
+			continue
+		}
+		if err != nil {
+			fail(row, "Internal server error", nil)
+			continue
+		}
+		if _, _, err := getBookById(trash, row.Book.Id); err == nil {
+			fail(row, "Book is in trash", nil)
+			continue
+		}
+		_, _, existsErr := getBookById(books, row.Book.Id)
+		if _, _, err := getBookById(batchBooks, row.Book.Id); err == nil {
+			existsErr = nil
+		}
+		if existsErr == nil && !upsert {
+			fail(row, "Book already exists", nil)
+			continue
+		}
+		// versions in the file are not checked, imported data wins
+		row.Book.Version = 0
+		row.Book.Cover = nil
+		batch = append(batch, row)
+		batchBooks = append(batchBooks, row.Book)
+	}
+
+	if len(batch) > 0 {
+		if upsert {
+			var changes []BookChange
+			changes, err = store.Upsert(batchBooks...)
+			for _, change := range changes {
+				if change.Before == nil {
+					result.Created++
+				} else {
+					result.Updated++
+				}
+			}
+		} else if err = store.Add(batchBooks...); err == nil {
+			result.Created += len(batch)
+		}
+	}
+	if err != nil && len(batch) > 0 {
+		msg := importErrorMessage(err)
+		for _, row := range batch {
+			fail(row, msg, nil)
+		}
+		sort.SliceStable(result.Errors, func(i, j int) bool {
+			return result.Errors[i].Row < result.Errors[j].Row
+		})
+	}
+	return result
+}
+
+// message of the rows failed with err
+func importErrorMessage(err error) string {
+	if errors.Is(err, ErrBookExists) {
+		return "Book already exists"
+	}
+	if errors.Is(err, ErrBookNotFound) {
+		return "Book is in trash"
+	}
+	log.Printf("Server Error %v\n", err)
+	return "Internal server error"
+}
+
+// command line tool to export, import and purge the catalog of a books file
+// usage: bookstore export|import|purge [-data books.json] [-audit audit.jsonl] [-format csv|ndjson] [-mode insert|upsert] [-retention 720h]
+// the books file must not be served at the same time, the command fails with
+// ErrCatalogLocked while a server has it open, a -db database can be shared
+func runCatalogCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 || !isCatalogCommand(args[0]) {
+		return errors.New("usage: bookstore export|import|purge|import-json [-data books.json] [-db driver:dsn] [-audit audit.jsonl] [-format csv|ndjson] [-mode insert|upsert] [-retention 720h]")
+	}
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	dataFile := flags.String("data", BOOKS_FILE, "books json file")
+	db := flags.String("db", os.Getenv("BOOKSTORE_DB"), "sql database as driver:dsn instead of the json file, env BOOKSTORE_DB")
+	auditFile := flags.String("audit", AUDIT_FILE, "audit log file, empty to not record changes")
+	format := flags.String("format", "csv", "catalog format, csv or ndjson")
+	mode := flags.String("mode", "insert", "import mode, insert or upsert")
+	retention := flags.Duration("retention", TRASH_RETENTION, "purge books in trash longer than this")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *format != "csv" && *format != "ndjson" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	if args[0] == "import-json" {
+		return runImportJSON(*dataFile, *db, stdout)
+	}
+
+	baseStore, err := openBookStore(*dataFile, *db)
+	if err != nil {
+		return err
+	}
+	defer closeBookStore(baseStore)
+	var store BookStore = baseStore
+	if *auditFile != "" {
+		store = NewAuditedStore(baseStore, NewFileAuditLog(*auditFile)).As("cli")
+	}
+
+	if args[0] == "purge" {
+		purged, err := purgeTrash(store, *retention)
+		fmt.Fprintf(stdout, "purged %d books\n", purged)
+		return err
+	}
+	if args[0] == "export" {
+		books, err := store.List()
+		if err != nil {
+			return err
+		}
+		return writeCatalog(stdout, *format, books)
+	}
+
+	if *mode != "insert" && *mode != "upsert" {
+		return fmt.Errorf("unknown mode %q", *mode)
+	}
+	rows, err := readCatalog(stdin, *format)
+	if err != nil {
+		return err
+	}
+	result := importCatalog(store, rows, *mode == "upsert")
+	resultByte, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Fprintln(stdout, string(resultByte))
+	if result.Failed > 0 {
+		return fmt.Errorf("%d rows failed", result.Failed)
+	}
+	return nil
+}
+
+// subcommands handled by runCatalogCommand
+func isCatalogCommand(name string) bool {
+	return name == "export" || name == "import" || name == "purge" || name == "import-json"
+}
+
+// copy the books of the json file into the empty sql database, once when moving to a database
+func runImportJSON(dataFile string, db string, stdout io.Writer) error {
+	if db == "" {
+		return errors.New("import-json needs -db driver:dsn")
+	}
+	store, err := openBookStore(dataFile, db)
+	if err != nil {
+		return err
+	}
+	defer closeBookStore(store)
+	importer, ok := store.(BookImporter)
+	if !ok {
+		return fmt.Errorf("db %q can not import books", db)
+	}
+	imported, err := importBooks(importer, dataFile)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "imported %d books\n", imported)
+	return nil
+}
+
+// settings of the server, flags override the BOOKSTORE_* environment variables
+type ServerConfig struct {
+	Addr              string
+	DataFile          string
+	Database          string
+	AuditFile         string
+	CoversDir         string
+	JWTIssuer         string
+	JWTAudience       string
+	JWTSecret         string
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	ShutdownTimeout   time.Duration
+	IdempotencyWindow time.Duration
+	TrashRetention    time.Duration
+	PurgeInterval     time.Duration
+}
+
+// read server config from the environment and the flags
+// usage: bookstore [serve] [-port 8080] [-data books.json] [-db driver:dsn] [-audit audit.jsonl] [-read-timeout 15s] ...
+func loadServerConfig(args []string) (ServerConfig, error) {
+	config := ServerConfig{
+		Addr:              envString("BOOKSTORE_PORT", PORT),
+		DataFile:          envString("BOOKSTORE_DATA", BOOKS_FILE),
+		Database:          os.Getenv("BOOKSTORE_DB"),
+		AuditFile:         envString("BOOKSTORE_AUDIT", AUDIT_FILE),
+		CoversDir:         envString("BOOKSTORE_COVERS", COVERS_DIR),
+		JWTIssuer:         os.Getenv("BOOKSTORE_JWT_ISSUER"),
+		JWTAudience:       os.Getenv("BOOKSTORE_JWT_AUDIENCE"),
+		JWTSecret:         os.Getenv("BOOKSTORE_JWT_SECRET"),
+		ReadTimeout:       READ_TIMEOUT,
+		WriteTimeout:      WRITE_TIMEOUT,
+		IdleTimeout:       IDLE_TIMEOUT,
+		ShutdownTimeout:   SHUTDOWN_TIMEOUT,
+		IdempotencyWindow: IDEMPOTENCY_WINDOW,
+		TrashRetention:    TRASH_RETENTION,
+		PurgeInterval:     PURGE_INTERVAL,
+	}
+	durations := []struct {
+		flag  string
+		env   string
+		value *time.Duration
+		usage string
+	}{
+		{"read-timeout", "BOOKSTORE_READ_TIMEOUT", &config.ReadTimeout, "maximum time to read a request"},
+		{"write-timeout", "BOOKSTORE_WRITE_TIMEOUT", &config.WriteTimeout, "maximum time to write a response"},
+		{"idle-timeout", "BOOKSTORE_IDLE_TIMEOUT", &config.IdleTimeout, "how long idle keep-alive connections stay open"},
+		{"shutdown-timeout", "BOOKSTORE_SHUTDOWN_TIMEOUT", &config.ShutdownTimeout, "how long to wait for requests on shutdown"},
+		{"idempotency-window", "BOOKSTORE_IDEMPOTENCY_WINDOW", &config.IdempotencyWindow, "how long responses are replayed for the same Idempotency-Key"},
+		{"retention", "BOOKSTORE_RETENTION", &config.TrashRetention, "purge books in trash longer than this"},
+		{"purge-interval", "BOOKSTORE_PURGE_INTERVAL", &config.PurgeInterval, "how often to purge the trash"},
+	}
+
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.StringVar(&config.Addr, "port", config.Addr, "port or address to listen on, env BOOKSTORE_PORT")
+	flags.StringVar(&config.DataFile, "data", config.DataFile, "books json file, env BOOKSTORE_DATA")
+	flags.StringVar(&config.Database, "db", config.Database, "sql database as driver:dsn instead of the json file, env BOOKSTORE_DB")
+	flags.StringVar(&config.AuditFile, "audit", config.AuditFile, "audit log file, empty to not record changes, env BOOKSTORE_AUDIT")
+	flags.StringVar(&config.CoversDir, "covers", config.CoversDir, "directory of the uploaded covers, env BOOKSTORE_COVERS")
+	flags.StringVar(&config.JWTIssuer, "jwt-issuer", config.JWTIssuer, "url of the go-jwt service issuing the tokens needed to change books, env BOOKSTORE_JWT_ISSUER")
+	flags.StringVar(&config.JWTAudience, "jwt-audience", config.JWTAudience, "aud the tokens must have, the issuer when empty, env BOOKSTORE_JWT_AUDIENCE")
+	flags.StringVar(&config.JWTSecret, "jwt-secret", config.JWTSecret, "secret of HS256 tokens of the issuer, empty to accept only tokens of its JWKS, env BOOKSTORE_JWT_SECRET")
+	for _, d := range durations {
+		if value := os.Getenv(d.env); value != "" {
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				return ServerConfig{}, fmt.Errorf("%s: %w", d.env, err)
+			}
+			*d.value = duration
+		}
+		flags.DurationVar(d.value, d.flag, *d.value, d.usage+", env "+d.env)
+	}
+	if err := flags.Parse(args); err != nil {
+		return ServerConfig{}, err
+	}
+	if flags.NArg() > 0 {
+		return ServerConfig{}, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+
+	// a bare port number listens on all interfaces
+	if isDigits(config.Addr) {
+		config.Addr = ":" + config.Addr
+	}
+	if config.JWTIssuer == "" {
+		return ServerConfig{}, errors.New("jwt-issuer must be set, changes need tokens of that issuer")
+	}
+	if config.PurgeInterval <= 0 {
+		return ServerConfig{}, errors.New("purge-interval must be positive")
+	}
+	return config, nil
+}
+
+// value of environment variable or fallback when it is not set
+func envString(name string, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return fallback
+}
+
+// serve the books until a signal arrives on stop, then wait for the
+// requests in flight up to ShutdownTimeout before returning
+func runServer(config ServerConfig, stop <-chan os.Signal) error {
+	baseStore, err := openBookStore(config.DataFile, config.Database)
+	if err != nil {
+		return err
+	}
+	defer closeBookStore(baseStore)
+	indexedStore, err := NewIndexedStore(baseStore)
+	if err != nil {
+		return err
+	}
+	var store BookStore = indexedStore
+	if config.AuditFile != "" {
+		store = NewAuditedStore(indexedStore, NewFileAuditLog(config.AuditFile))
+	}
+
+	covers, err := NewCoverStore(config.CoversDir)
+	if err != nil {
+		return err
+	}
+
+	stopPurge := make(chan struct{})
+	defer close(stopPurge)
+	startPurgeJob(store, config.TrashRetention, config.PurgeInterval, stopPurge)
+
+	server := &http.Server{
+		Addr:         config.Addr,
+		Handler:      NewRouter(store, NewTokenVerifier(config.JWTIssuer, config.JWTAudience, config.JWTSecret), covers, NewIdempotencyCache(config.IdempotencyWindow)),
+		ReadTimeout:  config.ReadTimeout,
+		WriteTimeout: config.WriteTimeout,
+		IdleTimeout:  config.IdleTimeout,
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Printf("Listening on %v\n", config.Addr)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-stop:
+		log.Printf("Received %v, shutting down\n", sig)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("shutdown: %w", err)
+	}
+	return nil
+}
+
+// bookstore export|import|purge|import-json run the catalog commands, anything else serves the api
+func main() {
+	args := os.Args[1:]
+	if len(args) > 0 && isCatalogCommand(args[0]) {
+		err := runCatalogCommand(args, os.Stdin, os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(args) > 0 && args[0] == "serve" {
+		args = args[1:]
+	}
+	config, err := loadServerConfig(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	if err := runServer(config, stop); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// apply merge patch or JSON Patch to the book
+// the book is patched as a generic json document and decoded back,
+// so unknown fields and invalid values are rejected
+func patchBook(book Book, jsonPatch bool, patchByte []byte) (Book, error) {
+	var patch interface{}
+	if err := decodeJSON(patchByte, &patch); err != nil {
+		return Book{}, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	bookByte, _ := json.Marshal(book)
+	var doc interface{}
+	if err := decodeJSON(bookByte, &doc); err != nil {
+		return Book{}, err
+	}
+
+	var err error
+	if jsonPatch {
+		doc, err = applyJSONPatch(doc, patch)
+	} else {
+		doc = mergePatch(doc, patch)
+	}
+	if err != nil {
+		return Book{}, err
+	}
+
+	docByte, _ := json.Marshal(doc)
+	decoder := json.NewDecoder(bytes.NewReader(docByte))
+	decoder.DisallowUnknownFields()
+	var patched Book
+	if err := decoder.Decode(&patched); err != nil {
+		if errors.Is(err, ErrInvalidPrice) {
+			return Book{}, err
+		}
+		return Book{}, fmt.Errorf("%w: %v", ErrPatchNotApplicable, err)
+	}
+	return patched, nil
+}
+
+// decode json keeping numbers as json.Number, so amounts are not rounded
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// apply JSON Merge Patch (RFC 7396), null removes the member
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+		} else {
+			targetObject[name] = mergePatch(targetObject[name], value)
+		}
+	}
+	return targetObject
+}
+
+// operation of a JSON Patch
+type patchOperation struct {
+	Op    string       `json:"op"`
+	Path  *string      `json:"path"`
+	From  *string      `json:"from"`
+	Value *interface{} `json:"value"`
+}
+
+// apply JSON Patch (RFC 6902), operations are applied in order and
+// the document is left unchanged when any of them fails
+func applyJSONPatch(doc interface{}, patch interface{}) (interface{}, error) {
+	patchByte, _ := json.Marshal(patch)
+	var operations []patchOperation
+	if err := decodeJSON(patchByte, &operations); err != nil {
+		return nil, fmt.Errorf("%w: json patch must be an array of operations", ErrInvalidPatch)
+	}
+
+	for i, operation := range operations {
+		if operation.Path == nil {
+			return nil, fmt.Errorf("%w: operation %d has no path", ErrInvalidPatch, i)
+		}
+		path, err := parsePointer(*operation.Path)
+		if err != nil {
+			return nil, err
+		}
+		needsValue := operation.Op == "add" || operation.Op == "replace" || operation.Op == "test"
+		if needsValue && operation.Value == nil {
+			return nil, fmt.Errorf("%w: operation %d has no value", ErrInvalidPatch, i)
+		}
+		var from []string
+		if operation.Op == "move" || operation.Op == "copy" {
+			if operation.From == nil {
+				return nil, fmt.Errorf("%w: operation %d has no from", ErrInvalidPatch, i)
+			}
+			if from, err = parsePointer(*operation.From); err != nil {
+				return nil, err
+			}
+		}
+
+		switch operation.Op {
+		case "add":
+			doc, err = pointerAdd(doc, path, *operation.Value)
+		case "remove":
+			doc, _, err = pointerRemove(doc, path)
+		case "replace":
+			if doc, _, err = pointerRemove(doc, path); err == nil {
+				doc, err = pointerAdd(doc, path, *operation.Value)
+			}
+		case "move":
+			var value interface{}
+			if doc, value, err = pointerRemove(doc, from); err == nil {
+				doc, err = pointerAdd(doc, path, value)
+			}
+		case "copy":
+			var value interface{}
+			if value, err = pointerGet(doc, from); err == nil {
+				doc, err = pointerAdd(doc, path, copyJSON(value))
+			}
+		case "test":
+			var value interface{}
+			if value, err = pointerGet(doc, path); err == nil && !equalJSON(value, *operation.Value) {
+				err = fmt.Errorf("%w: %s", ErrPatchTestFailed, *operation.Path)
+			}
+		default:
+			err = fmt.Errorf("%w: unknown operation %q", ErrInvalidPatch, operation.Op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// split JSON Pointer (RFC 6901) into unescaped reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w: path %q must start with /", ErrInvalidPatch, pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+// index of an array element, "-" is the end of the array when allowed
+func pointerIndex(array []interface{}, token string, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return len(array), nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || index > len(array) || (index == len(array) && !allowEnd) || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("%w: no element %s", ErrPatchNotApplicable, token)
+	}
+	return index, nil
+}
+
+// value at path
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("%w: no member %s", ErrPatchNotApplicable, token)
+			}
+			doc = value
+		case []interface{}:
+			index, err := pointerIndex(node, token, false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[index]
+		default:
+			return nil, fmt.Errorf("%w: %s is not in an object or array", ErrPatchNotApplicable, token)
+		}
+	}
+	return doc, nil
+}
+
+// add value at path, returns the changed document
+func pointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	token := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[token] = value
+		return doc, nil
+	case []interface{}:
+		index, err := pointerIndex(node, token, true)
+		if err != nil {
+			return nil, err
+		}
+		node = append(node, nil)
+		copy(node[index+1:], node[index:])
+		node[index] = value
+		return pointerReplaceArray(doc, path[:len(path)-1], node)
+	}
+	return nil, fmt.Errorf("%w: %s is not in an object or array", ErrPatchNotApplicable, token)
+}
+
+// remove value at path, returns the changed document and the removed value
+func pointerRemove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	token := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		value, ok := node[token]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: no member %s", ErrPatchNotApplicable, token)
+		}
+		delete(node, token)
+		return doc, value, nil
+	case []interface{}:
+		index, err := pointerIndex(node, token, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := node[index]
+		node = append(node[:index:index], node[index+1:]...)
+		doc, err = pointerReplaceArray(doc, path[:len(path)-1], node)
+		return doc, value, err
+	}
+	return nil, nil, fmt.Errorf("%w: %s is not in an object or array", ErrPatchNotApplicable, token)
+}
+
+// put resized array back to its parent, arrays are values and not shared
+func pointerReplaceArray(doc interface{}, path []string, array []interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return array, nil
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	token := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[token] = array
+	case []interface{}:
+		index, _ := pointerIndex(node, token, false)
+		node[index] = array
+	}
+	return doc, nil
+}
+
+// deep copy of a decoded json value
+func copyJSON(value interface{}) interface{} {
+	valueByte, _ := json.Marshal(value)
+	var copied interface{}
+	decodeJSON(valueByte, &copied)
+	return copied
+}
+
+// compare decoded json values, numbers by value so 1 equals 1.0 and 1e0
+func equalJSON(a interface{}, b interface{}) bool {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for name, value := range a {
+			other, ok := b[name]
+			if !ok || !equalJSON(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equalJSON(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number, float64:
+		x, ok := jsonNumber(a)
+		y, otherOk := jsonNumber(b)
+		return ok && otherOk && x.Cmp(y) == 0
+	}
+	return a == b
+}
+
+// value of a decoded json number, false when value is not a number
+func jsonNumber(value interface{}) (*big.Float, bool) {
+	number := new(big.Float).SetPrec(256)
+	switch value := value.(type) {
+	case json.Number:
+		_, ok := number.SetString(string(value))
+		return number, ok
+	case float64:
+		return number.SetFloat64(value), true
+	}
+	return nil, false
 }
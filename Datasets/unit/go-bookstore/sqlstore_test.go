@@ -0,0 +1,402 @@
+package main
+
+// tests of SQLStore against sqlite, the mutants share this directory so run them with
+// go test Datasets/unit/go-bookstore/bookstore.go Datasets/unit/go-bookstore/sqlstore_test.go
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// new sqlite database in a temp dir, migrated to the latest version
+func openTestStore(t *testing.T) *SQLStore {
+	t.Helper()
+	dsn := "file:" + filepath.Join(t.TempDir(), "books.db") + "?_pragma=busy_timeout(10000)"
+	store, err := OpenSQLStore("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func testBook(id string) Book {
+	return Book{Id: id, Title: "Title " + id, Author: "Author " + id, Price: Money{60000, "INR"}}
+}
+
+func TestSQLStoreAddListGet(t *testing.T) {
+	store := openTestStore(t)
+	if err := store.Add(testBook("2"), testBook("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add(testBook("3")); err != nil {
+		t.Fatal(err)
+	}
+
+	books, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids string
+	for _, book := range books {
+		ids += book.Id
+	}
+	if ids != "213" {
+		t.Errorf("List order = %q, want %q", ids, "213")
+	}
+
+	book, err := store.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.Title != "Title 1" || book.Price != (Money{60000, "INR"}) || book.Version != 1 {
+		t.Errorf("Get = %+v", book)
+	}
+	if _, err := store.Get("missing"); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("Get missing error = %v, want ErrBookNotFound", err)
+	}
+}
+
+func TestSQLStoreAddExisting(t *testing.T) {
+	store := openTestStore(t)
+	if err := store.Add(testBook("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add(testBook("2"), testBook("1")); !errors.Is(err, ErrBookExists) {
+		t.Errorf("Add existing error = %v, want ErrBookExists", err)
+	}
+	if err := store.Add(testBook("3"), testBook("3")); !errors.Is(err, ErrBookExists) {
+		t.Errorf("Add duplicate error = %v, want ErrBookExists", err)
+	}
+	// nothing of a failed add is stored
+	books, _ := store.List()
+	if len(books) != 1 {
+		t.Errorf("List has %d books, want 1", len(books))
+	}
+}
+
+func TestSQLStoreAddResetsVersionAndTrash(t *testing.T) {
+	store := openTestStore(t)
+	book := testBook("1")
+	deletedAt := time.Now()
+	book.Version = 7
+	book.DeletedAt = &deletedAt
+	if err := store.Add(book); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := store.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Version != 1 || stored.DeletedAt != nil {
+		t.Errorf("Add stored version %d deleted_at %v, want 1 and nil", stored.Version, stored.DeletedAt)
+	}
+}
+
+func TestSQLStoreUpsert(t *testing.T) {
+	store := openTestStore(t)
+	stored := testBook("1")
+	stored.Cover = &Cover{"/covers/a.png", "image/png", 10, 600, 900, 170, 256}
+	if err := store.Add(stored, testBook("2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Delete("2", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	book := testBook("1")
+	book.Title = "New title"
+	changes, err := store.Upsert(book, testBook("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes[0].Before == nil || changes[0].Before.Version != 1 || changes[1].Before != nil {
+		t.Fatalf("Upsert changes = %+v", changes)
+	}
+	updated, _ := store.Get("1")
+	if updated.Title != "New title" || updated.Version != 2 || updated.Cover == nil {
+		t.Errorf("Upsert updated = %+v, want new title at version 2 with the stored cover", updated)
+	}
+	if added, err := store.Get("3"); err != nil || added.Version != 1 {
+		t.Errorf("Upsert added = %+v, %v", added, err)
+	}
+
+	// nothing is written when a book is in trash
+	if _, err := store.Upsert(testBook("4"), testBook("2")); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("Upsert trashed error = %v, want ErrBookNotFound", err)
+	}
+	if _, err := store.Get("4"); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("Get after failed Upsert error = %v, want ErrBookNotFound", err)
+	}
+}
+
+func TestSQLStoreUpdate(t *testing.T) {
+	store := openTestStore(t)
+	if err := store.Add(testBook("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	book := testBook("1")
+	book.Title = "New title"
+	book.Version = 1
+	book.Cover = &Cover{"/covers/a.png", "image/png", 10, 600, 900, 170, 256}
+	change, err := store.Update(book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.After.Version != 2 || change.Before == nil || change.Before.Version != 1 || change.Before.Title != "Title 1" {
+		t.Errorf("Update change = %+v, want version 1 before and 2 after", change)
+	}
+	stored, _ := store.Get("1")
+	if stored.Title != "New title" || stored.Cover == nil || *stored.Cover != *book.Cover {
+		t.Errorf("Get after Update = %+v", stored)
+	}
+
+	// version 1 is stale now
+	if _, err := store.Update(book); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("stale Update error = %v, want ErrVersionMismatch", err)
+	}
+	book.Version = 0
+	if _, err := store.Update(book); err != nil {
+		t.Errorf("Update without version error = %v", err)
+	}
+	book.Id = "missing"
+	if _, err := store.Update(book); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("Update missing error = %v, want ErrBookNotFound", err)
+	}
+}
+
+func TestSQLStoreTrash(t *testing.T) {
+	store := openTestStore(t)
+	if err := store.Add(testBook("1"), testBook("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Delete("1", 5); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("stale Delete error = %v, want ErrVersionMismatch", err)
+	}
+	change, err := store.Delete("1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Before == nil || change.Before.DeletedAt != nil || change.After.DeletedAt == nil || change.After.Version != 2 {
+		t.Errorf("Delete change = %+v", change)
+	}
+	if _, err := store.Delete("1", 0); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("second Delete error = %v, want ErrBookNotFound", err)
+	}
+	if _, err := store.Get("1"); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("Get deleted error = %v, want ErrBookNotFound", err)
+	}
+	if books, _ := store.List(); len(books) != 1 || books[0].Id != "2" {
+		t.Errorf("List after Delete = %+v", books)
+	}
+
+	trash, err := store.Trash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 || trash[0].Id != "1" || trash[0].DeletedAt == nil || trash[0].Version != 2 {
+		t.Fatalf("Trash = %+v", trash)
+	}
+
+	change, err = store.Restore("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.After.Version != 3 || change.After.DeletedAt != nil || change.Before == nil || change.Before.DeletedAt == nil {
+		t.Errorf("Restore change = %+v", change)
+	}
+	if _, err := store.Restore("1"); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("Restore of active book error = %v, want ErrBookNotFound", err)
+	}
+	if books, _ := store.List(); len(books) != 2 || books[0].Id != "1" {
+		t.Errorf("restored book lost its position: %+v", books)
+	}
+}
+
+func TestSQLStorePurge(t *testing.T) {
+	store := openTestStore(t)
+	if err := store.Add(testBook("1"), testBook("2"), testBook("3")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Delete("1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Delete("2", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if purged, err := store.Purge(time.Now().Add(-time.Hour)); err != nil || len(purged) != 0 {
+		t.Errorf("Purge of old books = %+v, %v, want none", purged, err)
+	}
+	if purged, err := store.Purge(time.Now().Add(time.Second)); err != nil || len(purged) != 2 || purged[0].Id == "3" || purged[1].Id == "3" {
+		t.Errorf("Purge = %+v, %v, want 2 books", purged, err)
+	}
+	if trash, _ := store.Trash(); len(trash) != 0 {
+		t.Errorf("Trash after Purge = %+v", trash)
+	}
+	if books, _ := store.List(); len(books) != 1 {
+		t.Errorf("Purge removed active books: %+v", books)
+	}
+	// ids of purged books can be used again
+	if err := store.Add(testBook("1")); err != nil {
+		t.Errorf("Add after Purge error = %v", err)
+	}
+}
+
+func TestSQLStoreConcurrentAdd(t *testing.T) {
+	store := openTestStore(t)
+	const adds = 10
+	errs := make(chan error, 2*adds)
+	var wg sync.WaitGroup
+	for i := 0; i < adds; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			errs <- store.Add(testBook(fmt.Sprint(i)))
+		}(i)
+		// every id is added twice, exactly one of them wins
+		go func(i int) {
+			defer wg.Done()
+			errs <- store.Add(testBook(fmt.Sprint(i)))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	exists := 0
+	for err := range errs {
+		if errors.Is(err, ErrBookExists) {
+			exists++
+		} else if err != nil {
+			t.Errorf("concurrent Add error = %v", err)
+		}
+	}
+	if exists != adds {
+		t.Errorf("%d adds got ErrBookExists, want %d", exists, adds)
+	}
+	if books, _ := store.List(); len(books) != adds {
+		t.Errorf("List has %d books, want %d", len(books), adds)
+	}
+}
+
+func TestSQLStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.db")
+	store, err := OpenSQLStore("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add(testBook("1")); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// migrations already applied are skipped and the counter continues
+	store, err = OpenSQLStore("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Add(testBook("2")); err != nil {
+		t.Fatal(err)
+	}
+	if books, _ := store.List(); len(books) != 2 || books[1].Id != "2" {
+		t.Errorf("List after reopen = %+v", books)
+	}
+}
+
+func TestImportBooks(t *testing.T) {
+	store := openTestStore(t)
+	deletedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	trashed := testBook("2")
+	trashed.Version = 4
+	trashed.DeletedAt = &deletedAt
+	path := filepath.Join(t.TempDir(), "books.json")
+	if err := saveBooks(path, []Book{testBook("1"), trashed}); err != nil {
+		t.Fatal(err)
+	}
+
+	imported, err := importBooks(store, path)
+	if err != nil || imported != 2 {
+		t.Fatalf("importBooks = %d, %v, want 2", imported, err)
+	}
+	if books, _ := store.List(); len(books) != 1 || books[0].Id != "1" {
+		t.Errorf("List after import = %+v", books)
+	}
+	trash, _ := store.Trash()
+	if len(trash) != 1 || trash[0].Version != 4 || trash[0].DeletedAt == nil || !trash[0].DeletedAt.Equal(deletedAt) {
+		t.Errorf("trashed book was not imported as it is: %+v", trash)
+	}
+
+	if _, err := importBooks(store, path); !errors.Is(err, ErrBookExists) {
+		t.Errorf("second import error = %v, want ErrBookExists", err)
+	}
+}
+
+func TestImportJSONCommand(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "books.json")
+	if err := saveBooks(path, []Book{testBook("1"), testBook("2")}); err != nil {
+		t.Fatal(err)
+	}
+	db := "sqlite:" + filepath.Join(dir, "books.db")
+
+	var out bytes.Buffer
+	if err := runCatalogCommand([]string{"import-json", "-data", path, "-db", db}, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "imported 2 books\n" {
+		t.Errorf("import-json output = %q", out.String())
+	}
+	out.Reset()
+	if err := runCatalogCommand([]string{"export", "-db", db, "-audit", "", "-format", "ndjson"}, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(out.Bytes(), []byte("\n")); lines != 2 {
+		t.Errorf("export of the database has %d lines, want 2", lines)
+	}
+	if err := runCatalogCommand([]string{"import-json", "-data", path}, nil, &out); err == nil {
+		t.Error("import-json without -db did not fail")
+	}
+}
+
+func TestOpenBookStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openBookStore("", "sqlite:"+filepath.Join(dir, "books.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.(*SQLStore); !ok {
+		t.Errorf("openBookStore returned %T, want *SQLStore", store)
+	}
+	closeBookStore(store)
+
+	path := filepath.Join(dir, "books.json")
+	if err := ioutil.WriteFile(path, []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err = openBookStore(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.(*JSONFileStore); !ok {
+		t.Errorf("openBookStore returned %T, want *JSONFileStore", store)
+	}
+	defer closeBookStore(store)
+	if _, err := openBookStore(path, ""); !errors.Is(err, ErrCatalogLocked) {
+		t.Errorf("second open of the books file error = %v, want ErrCatalogLocked", err)
+	}
+
+	if _, err := openBookStore(path, "books.db"); err == nil {
+		t.Error("openBookStore without driver did not fail")
+	}
+}
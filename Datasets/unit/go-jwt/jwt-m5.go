@@ -1,16 +1,715 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/big"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Store the SECRET KEY SECRETLY :)
-var SECRET_KEY string = "AwesomeGolangSecret"
+// HS256 secret of the tokens without kid issued before signing keys, JWT_LEGACY_SECRET,
+// they are accepted for ROTATION_GRACE after start, never when it is empty
+var SECRET_KEY string = os.Getenv("JWT_LEGACY_SECRET")
+
+// public URL of this service, it is the base of the discovery document
+var ISSUER string = getenv("JWT_ISSUER", "http://localhost:4000")
+
+// aud of the issued tokens, Auth rejects tokens for other audiences
+var AUDIENCE string = getenv("JWT_AUDIENCE", ISSUER)
+
+// lifetimes of the tokens issued by LoginHandler and RefreshHandler
+var (
+	ACCESS_TOKEN_LIFETIME  time.Duration = getenvDuration("JWT_ACCESS_TOKEN_LIFETIME", 15*time.Minute)
+	REFRESH_TOKEN_LIFETIME time.Duration = getenvDuration("JWT_REFRESH_TOKEN_LIFETIME", 30*24*time.Hour)
+)
+
+// how long clients may cache the JWKS
+const JWKS_MAX_AGE time.Duration = 5 * time.Minute
+
+// how long a rotated signing key still verifies tokens, must be longer than the token lifetime
+const ROTATION_GRACE time.Duration = time.Hour
+
+// returned when the token names a key which is unknown or retired
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// key which signs tokens, its kid is put into the token header
+// Private is []byte for HS256, *rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey,
+// Public is the matching verification key. Keys loaded only for verification have no Private key
+type SigningKey struct {
+	Kid     string
+	Method  jwt.SigningMethod
+	Private interface{}
+	Public  interface{}
+	// zero for active keys, set when the key is rotated out
+	Expires time.Time
+}
+
+// signing methods by name, ES256 uses the P-256 curve
+var signingMethods = map[string]jwt.SigningMethod{
+	"HS256": jwt.SigningMethodHS256,
+	"RS256": jwt.SigningMethodRS256,
+	"ES256": jwt.SigningMethodES256,
+	"EdDSA": jwt.SigningMethodEdDSA,
+}
+
+// current signing key and all the keys which still verify tokens
+type KeySet struct {
+	mu      sync.RWMutex
+	current *SigningKey
+	keys    map[string]*SigningKey
+}
+
+// keys used by CreateJWT and ValidateJWT, loaded from the environment on start
+var Keys = NewKeySet()
+
+func init() {
+	if ACCESS_TOKEN_LIFETIME >= ROTATION_GRACE {
+		log.Fatalf("JWT_ACCESS_TOKEN_LIFETIME must be shorter than %v", ROTATION_GRACE)
+	}
+	if err := LoadKeysFromEnv(Keys); err != nil {
+		log.Fatalf("Key Error %v", err)
+	}
+	if path := os.Getenv("JWT_USERS_FILE"); path != "" {
+		store, err := NewFileUserStore(path)
+		if err != nil {
+			log.Fatalf("User Error %v", err)
+		}
+		Users = store
+	}
+	if err := bootstrapAdmin(Users); err != nil {
+		log.Fatalf("User Error %v", err)
+	}
+	if path := os.Getenv("JWT_REVOCATION_FILE"); path != "" {
+		store, err := NewFileRevocationStore(path)
+		if err != nil {
+			log.Fatalf("Revocation Error %v", err)
+		}
+		Revocations = store
+	}
+	if sources := os.Getenv("JWT_TOKEN_SOURCES"); sources != "" {
+		extractors, err := ParseTokenSources(sources)
+		if err != nil {
+			log.Fatalf("Token Source Error %v", err)
+		}
+		TokenExtractors = extractors
+	}
+}
+
+// create empty key set, it can not sign until a key is added with Rotate
+func NewKeySet() *KeySet {
+	return &KeySet{keys: map[string]*SigningKey{}}
+}
+
+// Rotate makes key the signing key, the previous signing key verifies tokens for grace
+func (ks *KeySet) Rotate(key *SigningKey, grace time.Duration) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if ks.current != nil {
+		ks.current.Expires = time.Now().Add(grace)
+	}
+	ks.current = key
+	ks.keys[key.Kid] = key
+	ks.prune()
+}
+
+// Trust key for verification only, e.g. the public key of a retired signing key
+func (ks *KeySet) Trust(key *SigningKey) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys[key.Kid] = key
+}
+
+// remove keys after their expiry
+func (ks *KeySet) prune() {
+	now := time.Now()
+	for kid, key := range ks.keys {
+		if !key.Expires.IsZero() && now.After(key.Expires) {
+			delete(ks.keys, kid)
+		}
+	}
+}
+
+// Sign claims with the current key and put its kid into the header
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	ks.mu.RLock()
+	current := ks.current
+	ks.mu.RUnlock()
+	if current == nil {
+		return "", errors.New("no signing key")
+	}
+	token := jwt.NewWithClaims(current.Method, claims)
+	token.Header["kid"] = current.Kid
+	return token.SignedString(current.Private)
+}
+
+// Lookup is a jwt.Keyfunc returning the verification key named by the kid header
+// the algorithm of the token must be the one of the key
+func (ks *KeySet) Lookup(token *jwt.Token) (interface{}, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	kid, _ := token.Header["kid"].(string)
+	key, ok := ks.keys[kid]
+	if !ok || (!key.Expires.IsZero() && time.Now().After(key.Expires)) {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("%w: %q is not a %s key", ErrUnknownKey, kid, token.Method.Alg())
+	}
+	return key.Public, nil
+}
+
+// rotate to a new generated key of the same kind every interval until stop is closed
+// generated keys live only in memory, tokens signed with them do not survive a restart
+func startKeyRotation(ks *KeySet, interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			ks.mu.RLock()
+			alg := "HS256"
+			if ks.current != nil {
+				alg = ks.current.Method.Alg()
+			}
+			ks.mu.RUnlock()
+			key, err := GenerateSigningKey(alg)
+			if err != nil {
+				log.Printf("Key Error %v\n", err)
+				continue
+			}
+			ks.Rotate(key, ROTATION_GRACE)
+			log.Printf("Rotated signing key to %v\n", key.Kid)
+		}
+	}()
+}
+
+// generate a new random key for the signing method alg
+func GenerateSigningKey(alg string) (*SigningKey, error) {
+	var private interface{}
+	var err error
+	switch alg {
+	case "HS256":
+		secret := make([]byte, 32)
+		_, err = rand.Read(secret)
+		private = secret
+	case "RS256":
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "EdDSA":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing method %q", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newSigningKey("", private)
+}
+
+// signing key for private key or HMAC secret, kid is derived from the key when empty
+func newSigningKey(kid string, private interface{}) (*SigningKey, error) {
+	key := &SigningKey{Kid: kid, Private: private}
+	switch private := private.(type) {
+	case []byte:
+		key.Method, key.Public = jwt.SigningMethodHS256, private
+	case *rsa.PrivateKey:
+		key.Method, key.Public = jwt.SigningMethodRS256, &private.PublicKey
+	case *ecdsa.PrivateKey:
+		if private.Curve != elliptic.P256() {
+			return nil, errors.New("ES256 needs a P-256 key")
+		}
+		key.Method, key.Public = jwt.SigningMethodES256, &private.PublicKey
+	case ed25519.PrivateKey:
+		key.Method, key.Public = jwt.SigningMethodEdDSA, private.Public()
+	default:
+		return nil, fmt.Errorf("unsupported private key %T", private)
+	}
+	if key.Kid == "" {
+		key.Kid = keyID(key)
+	}
+	return key, nil
+}
+
+// verification only key for public key, kid is derived from the key when empty
+func newVerificationKey(kid string, public interface{}) (*SigningKey, error) {
+	key := &SigningKey{Kid: kid, Public: public}
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		key.Method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		if public.Curve != elliptic.P256() {
+			return nil, errors.New("ES256 needs a P-256 key")
+		}
+		key.Method = jwt.SigningMethodES256
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported public key %T", public)
+	}
+	if key.Kid == "" {
+		key.Kid = keyID(key)
+	}
+	return key, nil
+}
+
+// kid derived from the public key, so every service computes the same one
+// the kid of an HMAC secret is an HMAC of a fixed label, so replicas sharing
+// the secret and restarts agree on it without revealing the secret
+func keyID(key *SigningKey) string {
+	var sum []byte
+	if secret, ok := key.Public.([]byte); ok {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte("jwt kid"))
+		sum = mac.Sum(nil)
+	} else {
+		der, _ := x509.MarshalPKIXPublicKey(key.Public)
+		digest := sha256.Sum256(der)
+		sum = digest[:]
+	}
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+// parse PEM encoded private key (PKCS#8, PKCS#1 or SEC 1) or public key (PKIX or PKCS#1)
+func parsePEMKey(kid string, data []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newSigningKey(kid, private)
+	case "RSA PRIVATE KEY":
+		private, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newSigningKey(kid, private)
+	case "EC PRIVATE KEY":
+		private, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newSigningKey(kid, private)
+	case "PUBLIC KEY":
+		public, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newVerificationKey(kid, public)
+	case "RSA PUBLIC KEY":
+		public, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newVerificationKey(kid, public)
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+// value of environment variable or fallback when it is not set
+func getenv(name string, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return fallback
+}
+
+// duration in environment variable or fallback when it is not set
+// invalid values stop the service, a typo should not silently change a lifetime
+func getenvDuration(name string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Fatalf("%s must be a positive duration, e.g. 15m", name)
+	}
+	return duration
+}
+
+// public key in JWK format (RFC 7517), members depend on the key type
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC and OKP
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JSON Web Key Set served at /.well-known/jwks.json
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// minimal OpenID Connect style discovery document
+type Discovery struct {
+	Issuer                           string   `json:"issuer"`
+	JWKSURI                          string   `json:"jwks_uri"`
+	TokenEndpoint                    string   `json:"token_endpoint"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+	// not part of OpenID Connect, list of revoked tokens, see RevocationListHandler
+	RevocationListURI string `json:"revocation_list_uri"`
+}
+
+// public keys of the key set, HMAC secrets are never published
+func (ks *KeySet) JWKS() JWKS {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	jwks := JWKS{Keys: []JWK{}}
+	now := time.Now()
+	for _, key := range ks.keys {
+		if !key.Expires.IsZero() && now.After(key.Expires) {
+			continue
+		}
+		if jwk, ok := publicJWK(key); ok {
+			jwks.Keys = append(jwks.Keys, jwk)
+		}
+	}
+	sort.Slice(jwks.Keys, func(i, j int) bool { return jwks.Keys[i].Kid < jwks.Keys[j].Kid })
+	return jwks
+}
+
+// JWK of the public key, false for HMAC keys
+func publicJWK(key *SigningKey) (JWK, bool) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwk := JWK{Kid: key.Kid, Use: "sig", Alg: key.Method.Alg()}
+	switch public := key.Public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty, jwk.N, jwk.E = "RSA", b64(public.N.Bytes()), b64(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		jwk.Kty, jwk.Crv = "EC", public.Curve.Params().Name
+		jwk.X, jwk.Y = b64(public.X.FillBytes(make([]byte, size))), b64(public.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.Kty, jwk.Crv, jwk.X = "OKP", "Ed25519", b64(public)
+	default:
+		return JWK{}, false
+	}
+	return jwk, true
+}
+
+// verification key of a JWK, only signature keys of the supported methods are accepted
+func (jwk JWK) key() (*SigningKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return nil, fmt.Errorf("key %q is not a signature key", jwk.Kid)
+	}
+	var public interface{}
+	switch {
+	case jwk.Kty == "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("key %q has invalid exponent", jwk.Kid)
+		}
+		public = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case jwk.Kty == "EC" && jwk.Crv == "P-256":
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		ecKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !ecKey.Curve.IsOnCurve(ecKey.X, ecKey.Y) {
+			return nil, fmt.Errorf("key %q is not on P-256", jwk.Kid)
+		}
+		public = ecKey
+	case jwk.Kty == "OKP" && jwk.Crv == "Ed25519":
+		x, err := decode(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("key %q is not an Ed25519 key", jwk.Kid)
+		}
+		public = ed25519.PublicKey(x)
+	default:
+		return nil, fmt.Errorf("key %q has unsupported type %s %s", jwk.Kid, jwk.Kty, jwk.Crv)
+	}
+	key, err := newVerificationKey(jwk.Kid, public)
+	if err == nil && jwk.Alg != "" && jwk.Alg != key.Method.Alg() {
+		return nil, fmt.Errorf("key %q is not a %s key", jwk.Kid, jwk.Alg)
+	}
+	return key, err
+}
+
+// Handle /.well-known/jwks.json
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	jwksByte, _ := json.Marshal(Keys.JWKS())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(JWKS_MAX_AGE.Seconds())))
+	w.Write(jwksByte)
+}
+
+// Handle /.well-known/openid-configuration
+func DiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+	issuer := strings.TrimSuffix(ISSUER, "/")
+	discovery := Discovery{issuer, issuer + "/.well-known/jwks.json", issuer + "/login", validMethods(), issuer + "/revocations"}
+	discoveryByte, _ := json.Marshal(discovery)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(discoveryByte)
+}
+
+// verifies tokens of another service with the keys of its JWKS
+// the JWKS is cached for JWKS_MAX_AGE and fetched again early when a token
+// names an unknown kid, at most once per MinRefresh
+// tokens must be issued by Issuer for Audience, like ParseJWT checks for this service
+type JWKSVerifier struct {
+	URL        string
+	Issuer     string
+	Audience   string
+	Client     *http.Client
+	MinRefresh time.Duration
+
+	mu      sync.Mutex
+	keys    map[string]*SigningKey
+	fetched time.Time
+	// closed when the running fetch is done, nil when none runs
+	fetching chan struct{}
+}
+
+// create verifier for the JWKS at url of issuer, accepting tokens for audience
+func NewJWKSVerifier(url string, issuer string, audience string) *JWKSVerifier {
+	return &JWKSVerifier{URL: url, Issuer: issuer, Audience: audience, Client: &http.Client{Timeout: 10 * time.Second}, MinRefresh: 10 * time.Second}
+}
+
+// create verifier for the JWKS named by the discovery document of issuer
+func DiscoverJWKSVerifier(issuer string, audience string) (*JWKSVerifier, error) {
+	verifier := NewJWKSVerifier("", issuer, audience)
+	var discovery Discovery
+	if err := verifier.getJSON(strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return nil, fmt.Errorf("discovery document is for issuer %q, not %q", discovery.Issuer, issuer)
+	}
+	if discovery.JWKSURI == "" {
+		return nil, errors.New("discovery document has no jwks_uri")
+	}
+	verifier.URL = discovery.JWKSURI
+	return verifier, nil
+}
+
+// Verify token and return its claims
+// exp, nbf and iat are checked by the jwt package, iss and aud here
+func (v *JWKSVerifier) Verify(tokenString string) (*MyCustomClaims, error) {
+	claims := &MyCustomClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, v.Lookup, jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA"}))
+	if err != nil {
+		return nil, err
+	}
+	if !claims.VerifyIssuer(v.Issuer, true) || !claims.VerifyAudience(v.Audience, true) {
+		return nil, ErrWrongAudience
+	}
+	return claims, nil
+}
+
+// Lookup is a jwt.Keyfunc returning the key of the JWKS named by the kid header
+func (v *JWKSVerifier) Lookup(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok, refresh := v.cachedKey(kid)
+	if refresh {
+		v.refresh()
+		key, ok, _ = v.cachedKey(kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("%w: %q is not a %s key", ErrUnknownKey, kid, token.Method.Alg())
+	}
+	return key.Public, nil
+}
+
+// cached key of kid, refresh is true when the JWKS should be fetched first
+func (v *JWKSVerifier) cachedKey(kid string) (*SigningKey, bool, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key, ok := v.keys[kid]
+	stale := time.Since(v.fetched) > JWKS_MAX_AGE
+	return key, ok, stale || (!ok && (v.fetching != nil || time.Since(v.fetched) > v.MinRefresh))
+}
+
+// fetch the JWKS without holding the lock, callers arriving while a fetch
+// runs wait for it instead of starting their own
+func (v *JWKSVerifier) refresh() {
+	v.mu.Lock()
+	if done := v.fetching; done != nil {
+		v.mu.Unlock()
+		<-done
+		return
+	}
+	done := make(chan struct{})
+	v.fetching = done
+	v.fetched = time.Now()
+	v.mu.Unlock()
+
+	keys, err := v.fetchKeys()
+
+	v.mu.Lock()
+	if err != nil {
+		// keep using the cached keys while the JWKS can not be fetched
+		log.Printf("JWKS Error %v\n", err)
+	} else {
+		v.keys = keys
+	}
+	v.fetching = nil
+	v.mu.Unlock()
+	close(done)
+}
+
+// get the keys of the JWKS, keys which can not be used are skipped
+func (v *JWKSVerifier) fetchKeys() (map[string]*SigningKey, error) {
+	var jwks JWKS
+	if err := v.getJSON(v.URL, &jwks); err != nil {
+		return nil, err
+	}
+	keys := map[string]*SigningKey{}
+	for _, jwk := range jwks.Keys {
+		key, err := jwk.key()
+		if err != nil {
+			log.Printf("JWKS Error %v\n", err)
+			continue
+		}
+		keys[key.Kid] = key
+	}
+	return keys, nil
+}
+
+func (v *JWKSVerifier) getJSON(url string, target interface{}) error {
+	response, err := v.Client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return fmt.Errorf("GET %s: %s", url, response.Status)
+	}
+	return json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(target)
+}
+
+// configure keys from the environment
+//
+//	JWT_SIGNING_KEY or JWT_SIGNING_KEY_FILE  PEM private key, anything else is an HS256 secret
+//	JWT_KID                                  kid of the signing key, derived from the key when empty
+//	JWT_SIGNING_ALG                          generate a key for HS256, RS256, ES256 or EdDSA when none is given
+//	JWT_VERIFICATION_KEYS                    comma separated PEM files of keys which still verify tokens,
+//	                                         the file name without extension is the kid
+//	JWT_ROTATION_INTERVAL                    rotate to a generated key this often, e.g. 24h
+//	JWT_LEGACY_SECRET                        HS256 secret of tokens without kid, they stay valid for ROTATION_GRACE
+//
+// without a signing key tokens are signed with a generated ES256 key, they do not survive a restart
+func LoadKeysFromEnv(ks *KeySet) error {
+	signingKey := []byte(os.Getenv("JWT_SIGNING_KEY"))
+	if path := os.Getenv("JWT_SIGNING_KEY_FILE"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		signingKey = data
+	}
+
+	var key *SigningKey
+	var err error
+	if len(signingKey) > 0 && strings.Contains(string(signingKey), "-----BEGIN") {
+		key, err = parsePEMKey(os.Getenv("JWT_KID"), signingKey)
+	} else if len(signingKey) > 0 {
+		key, err = newSigningKey(os.Getenv("JWT_KID"), signingKey)
+	} else if alg := os.Getenv("JWT_SIGNING_ALG"); alg != "" {
+		key, err = GenerateSigningKey(alg)
+	}
+	if err != nil {
+		return fmt.Errorf("signing key: %w", err)
+	}
+	if key != nil && key.Private == nil {
+		return errors.New("signing key: public key can not sign")
+	}
+
+	if paths := os.Getenv("JWT_VERIFICATION_KEYS"); paths != "" {
+		for _, path := range strings.Split(paths, ",") {
+			path = strings.TrimSpace(path)
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			verificationKey, err := parsePEMKey(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)), data)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			ks.Trust(verificationKey)
+		}
+	}
+
+	if interval := os.Getenv("JWT_ROTATION_INTERVAL"); interval != "" {
+		duration, err := time.ParseDuration(interval)
+		if err != nil || duration <= ROTATION_GRACE {
+			return fmt.Errorf("JWT_ROTATION_INTERVAL must be a duration longer than %v", ROTATION_GRACE)
+		}
+		if key == nil {
+			if key, err = GenerateSigningKey("HS256"); err != nil {
+				return err
+			}
+		}
+		startKeyRotation(ks, duration, nil)
+	}
+	if key == nil {
+		log.Println("No JWT_SIGNING_KEY, signing with a generated ES256 key, tokens do not survive a restart")
+		if key, err = GenerateSigningKey("ES256"); err != nil {
+			return err
+		}
+	}
+	if SECRET_KEY != "" {
+		secret := []byte(SECRET_KEY)
+		ks.Trust(&SigningKey{"", jwt.SigningMethodHS256, nil, secret, time.Now().Add(ROTATION_GRACE)})
+	}
+	ks.Rotate(key, ROTATION_GRACE)
+	return nil
+}
 
 // To capture credentials from request which is needed to generate JWT
 type User struct {
@@ -32,48 +731,250 @@ func jsonMessageByte(status string, msg string) []byte {
 }
 
 // Custom claims needed for generating JWT token
+// UserName repeats sub for clients reading user_name
 type MyCustomClaims struct {
 	UserName     string `json:"user_name"`
 	LoggedInTime string
+	Roles        []string `json:"roles,omitempty"`
+	// space separated, like the scope of OAuth 2.0
+	Scope  string                 `json:"scope,omitempty"`
+	Custom map[string]interface{} `json:"custom,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// scopes of the scope claim
+func (c *MyCustomClaims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// authenticated user a token is issued for
+type Principal struct {
+	Subject string
+	Roles   []string
+	Scopes  []string
+	// put into the custom claim of the token
+	Claims map[string]interface{}
+}
+
+// scopes granted to the users of a role
+var ROLE_SCOPES = map[string][]string{
+	"admin": {"secure:read", "users:write"},
+	"user":  {"secure:read"},
+}
+
+// principal of the account of a logged in user, its scopes come from its roles
+func accountPrincipal(account Account) Principal {
+	var scopes []string
+	seen := map[string]bool{}
+	for _, role := range account.Roles {
+		for _, scope := range ROLE_SCOPES[role] {
+			if !seen[scope] {
+				seen[scope] = true
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	return Principal{Subject: account.UserName, Roles: account.Roles, Scopes: scopes}
+}
+
 // Function to create JWT token
-func CreateJWT() (string, error) {
-	currentTime := time.Now().Format("02-01-2006 15:04:05")
+func CreateJWT(user Principal) (string, error) {
+	now := time.Now()
 
-	// Storing user name and loggedin time
-	// Token expires in 1 min. This is just for testing
+	// Storing user and loggedin time
+	// Token expires after ACCESS_TOKEN_LIFETIME, clients get a new one with their refresh token
 	claims := MyCustomClaims{
-		"Akilan",
-		currentTime,
+		user.Subject,
+		now.Format("02-01-2006 15:04:05"),
+		user.Roles,
+		strings.Join(user.Scopes, " "),
+		user.Claims,
 		jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(1 * time.Minute)),
-			Issuer:    "Akilan",
+			Subject:   user.Subject,
+			Issuer:    ISSUER,
+			Audience:  jwt.ClaimStrings{AUDIENCE},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ACCESS_TOKEN_LIFETIME)),
+			// jti names the token in the revocation list
+			ID: newTokenID(),
 		},
 	}
 
-	// Generate token with HS256 algorithm and custom claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	// Sign the token with our secret key
-	signedToken, err := token.SignedString([]byte(SECRET_KEY))
+	// Sign the token with the current key of Keys, HS256 with our secret key by default
+	signedToken, err := Keys.Sign(claims)
 
 	return signedToken, err
 }
 
+// returned by ParseJWT for tokens which are valid but not accepted by this service
+var (
+	ErrTokenRevoked  = errors.New("token is revoked")
+	ErrWrongAudience = errors.New("token is not issued by or for this service")
+)
+
 // Function to validate JWT
 // Get the token from user and validate it
 func ValidateJWT(tokenString string) bool {
-	token, err := jwt.ParseWithClaims(tokenString, &MyCustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(SECRET_KEY), nil
-	})
+	_, err := ParseJWT(tokenString)
+	return err == nil
+}
+
+// Parse and validate JWT, returns its claims
+// exp, nbf and iat are checked by the jwt package, iss and aud here
+func ParseJWT(tokenString string) (*MyCustomClaims, error) {
+	// the kid of the token selects the key, so tokens of rotated keys stay valid
+	token, err := jwt.ParseWithClaims(tokenString, &MyCustomClaims{}, Keys.Lookup, jwt.WithValidMethods(validMethods()))
+	if token == nil {
+		log.Println(err)
+		return nil, err
+	}
 
 	if claims, ok := token.Claims.(*MyCustomClaims); ok && token.Valid {
-		log.Printf("%v - %v - %v \n", claims.UserName, claims.LoggedInTime, claims.RegisteredClaims.Issuer)
-		return true
+		if !claims.VerifyIssuer(ISSUER, true) || !claims.VerifyAudience(AUDIENCE, true) {
+			log.Printf("Token %v has issuer %v and audience %v\n", claims.ID, claims.Issuer, claims.Audience)
+			return nil, ErrWrongAudience
+		}
+		if tokenRevoked(claims) {
+			log.Printf("Token %v is revoked\n", claims.ID)
+			return nil, ErrTokenRevoked
+		}
+		log.Printf("%v - %v - %v \n", claims.Subject, claims.LoggedInTime, claims.Issuer)
+		return claims, nil
 	} else {
 		log.Println(err)
-		return false
+		return nil, err
+	}
+}
+
+type claimsKey struct{}
+
+// claims of the token of the request, put into the context by Auth
+func ClaimsFromContext(ctx context.Context) (*MyCustomClaims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*MyCustomClaims)
+	return claims, ok
+}
+
+// names of the supported signing methods
+func validMethods() []string {
+	methods := make([]string, 0, len(signingMethods))
+	for name := range signingMethods {
+		methods = append(methods, name)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// realm of the WWW-Authenticate challenges
+const AUTH_REALM = "jwt"
+
+// returned by token extractors for requests with a malformed token
+var ErrMalformedToken = errors.New("malformed token")
+
+// finds the token of a request, empty when the request has none
+type TokenExtractor func(r *http.Request) (string, error)
+
+// extractors tried by Auth in order, the first token found is used
+// set from JWT_TOKEN_SOURCES, e.g. "bearer,header:Token,cookie:access_token"
+var TokenExtractors = []TokenExtractor{BearerExtractor, HeaderExtractor("Token")}
+
+// token of the Authorization header with the Bearer scheme, other schemes are ignored
+func BearerExtractor(r *http.Request) (string, error) {
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return "", nil
+	}
+	scheme, token := authorization, ""
+	if i := strings.IndexByte(authorization, ' '); i >= 0 {
+		scheme, token = authorization[:i], strings.TrimSpace(authorization[i+1:])
+	}
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", nil
+	}
+	if token == "" || strings.ContainsAny(token, " \t") {
+		return "", fmt.Errorf("%w: Authorization header must be Bearer and the token", ErrMalformedToken)
+	}
+	return token, nil
+}
+
+// token of the header name, like the Token header of old clients
+func HeaderExtractor(name string) TokenExtractor {
+	return func(r *http.Request) (string, error) {
+		return r.Header.Get(name), nil
+	}
+}
+
+// token of the cookie name
+func CookieExtractor(name string) TokenExtractor {
+	return func(r *http.Request) (string, error) {
+		cookie, err := r.Cookie(name)
+		if err != nil {
+			return "", nil
+		}
+		return cookie.Value, nil
+	}
+}
+
+// token of the query parameter name, it ends up in access logs so use it only for links
+func QueryExtractor(name string) TokenExtractor {
+	return func(r *http.Request) (string, error) {
+		return r.URL.Query().Get(name), nil
+	}
+}
+
+// extractors of a comma separated list of bearer, header:name, cookie:name and query:name
+func ParseTokenSources(sources string) ([]TokenExtractor, error) {
+	var extractors []TokenExtractor
+	for _, source := range strings.Split(sources, ",") {
+		kind, name := strings.TrimSpace(source), ""
+		if i := strings.IndexByte(kind, ':'); i >= 0 {
+			kind, name = kind[:i], kind[i+1:]
+		}
+		switch {
+		case kind == "bearer" && name == "":
+			extractors = append(extractors, BearerExtractor)
+		case kind == "header" && name != "":
+			extractors = append(extractors, HeaderExtractor(name))
+		case kind == "cookie" && name != "":
+			extractors = append(extractors, CookieExtractor(name))
+		case kind == "query" && name != "":
+			extractors = append(extractors, QueryExtractor(name))
+		default:
+			return nil, fmt.Errorf("unknown token source %q", source)
+		}
+	}
+	return extractors, nil
+}
+
+// token of the request found by TokenExtractors
+func extractToken(r *http.Request) (string, error) {
+	for _, extractor := range TokenExtractors {
+		token, err := extractor(r)
+		if token != "" || err != nil {
+			return token, err
+		}
+	}
+	return "", nil
+}
+
+// value of WWW-Authenticate as of RFC 6750, without error for requests without token
+func bearerChallenge(errorCode string, description string) string {
+	challenge := fmt.Sprintf(`Bearer realm="%s"`, AUTH_REALM)
+	if errorCode != "" {
+		challenge += fmt.Sprintf(`, error="%s", error_description="%s"`, errorCode, description)
+	}
+	return challenge
+}
+
+// error_description of a token ParseJWT rejected
+func tokenErrorDescription(err error) string {
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return "The access token expired"
+	case errors.Is(err, ErrTokenRevoked):
+		return "The access token is revoked"
+	default:
+		return "The access token is invalid"
 	}
 }
 
@@ -81,20 +982,94 @@ func ValidateJWT(tokenString string) bool {
 func Auth(handler func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Get the JWT token from request header
-		if r.Header["Token"] != nil {
-			providedToken := r.Header["Token"][0]
-			if ValidateJWT(providedToken) {
-				handler(w, r)
+		// Get the JWT token from the request, see TokenExtractors
+		providedToken, err := extractToken(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", bearerChallenge("invalid_request", "The request has a malformed access token"))
+			w.WriteHeader(400)
+			w.Write(jsonMessageByte("Failed", err.Error()))
+		} else if providedToken != "" {
+			if claims, err := ParseJWT(providedToken); err == nil {
+				handler(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
 			} else {
+				w.Header().Set("WWW-Authenticate", bearerChallenge("invalid_token", tokenErrorDescription(err)))
 				w.WriteHeader(401)
 				w.Write(jsonMessageByte("Failed", "You are not authorized to view this page"))
 			}
 		} else {
+			w.Header().Set("WWW-Authenticate", bearerChallenge("", ""))
 			w.WriteHeader(401)
-			w.Write(jsonMessageByte("Failed", "Please provide valid JWT token in request header as Token"))
+			w.Write(jsonMessageByte("Failed", "Please provide valid JWT token in the Authorization header as Bearer token"))
+		}
+
+	})
+}
+
+// roles and scopes a route requires on top of a valid token
+// the token needs one of Roles and all of Scopes, empty lists require nothing
+type Policy struct {
+	Roles  []string
+	Scopes []string
+}
+
+// reasons of PolicyDenial
+const (
+	REASON_MISSING_ROLE  = "missing_role"
+	REASON_MISSING_SCOPE = "missing_scope"
+)
+
+// body of the 403 response for a valid token without the roles or scopes of the route
+type PolicyDenial struct {
+	Status   string   `json:"status"`
+	Msg      string   `json:"message"`
+	Reason   string   `json:"reason"`
+	Required []string `json:"required"`
+	Granted  []string `json:"granted"`
+}
+
+// Check returns the denial for claims, nil when the policy allows them
+func (p Policy) Check(claims *MyCustomClaims) *PolicyDenial {
+	if len(p.Roles) > 0 && !containsAny(claims.Roles, p.Roles) {
+		return &PolicyDenial{"Failed", "One of the roles " + strings.Join(p.Roles, ", ") + " is required", REASON_MISSING_ROLE, p.Roles, claims.Roles}
+	}
+	granted := claims.Scopes()
+	for _, scope := range p.Scopes {
+		if !containsAny(granted, []string{scope}) {
+			return &PolicyDenial{"Failed", "Scope " + scope + " is required", REASON_MISSING_SCOPE, p.Scopes, granted}
+		}
+	}
+	return nil
+}
+
+// true when values has one of wanted
+func containsAny(values []string, wanted []string) bool {
+	for _, value := range values {
+		for _, w := range wanted {
+			if value == w {
+				return true
+			}
 		}
+	}
+	return false
+}
 
+// Middleware auth handler which also checks the policy of the route
+// valid tokens without the roles or scopes of the policy get 403
+func Authorize(policy Policy, handler func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return Auth(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := ClaimsFromContext(r.Context())
+		if denial := policy.Check(claims); denial != nil {
+			log.Printf("Denied %v to %v: %v\n", r.URL.Path, claims.Subject, denial.Msg)
+			if denial.Reason == REASON_MISSING_SCOPE {
+				challenge := bearerChallenge("insufficient_scope", denial.Msg)
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`%s, scope="%s"`, challenge, strings.Join(policy.Scopes, " ")))
+			}
+			denialByte, _ := json.Marshal(denial)
+			w.WriteHeader(403)
+			w.Write(denialByte)
+			return
+		}
+		handler(w, r)
 	})
 }
 
@@ -110,12 +1085,16 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(400)
 			w.Write(jsonMessageByte("Failed", "Bad Request - Failed to parse the payload "))
 		} else {
-			log.Printf("User name - %v and Password is %v\n", userData.UserName, userData.Password)
-			// user name and password is hard code
-			// We can use DB
-			if userData.UserName == "admin" && userData.Password == "admin" {
-				token, _ := CreateJWT()
-				w.Write(jsonMessageByte("Success", token))
+			// user name and password are checked against the password hash of the user store
+			if account, ok := authenticate(userData.UserName, userData.Password); ok {
+				refreshToken, err := RefreshTokens.Issue(account.UserName, "")
+				if err != nil {
+					log.Println(err)
+					w.WriteHeader(500)
+					w.Write(jsonMessageByte("Failed", "Internal server error"))
+					return
+				}
+				writeTokenPair(w, accountPrincipal(account), refreshToken)
 			} else {
 				w.WriteHeader(404)
 				w.Write(jsonMessageByte("Failed", "Invalid credentials"))
@@ -125,6 +1104,775 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// access and refresh token issued by LoginHandler and RefreshHandler
+// message keeps the access token for clients of the single token response
+type TokenResponse struct {
+	Status       string `json:"status"`
+	Msg          string `json:"message"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// body of /refresh
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// create access token and send it together with refreshToken
+func writeTokenPair(w http.ResponseWriter, user Principal, refreshToken string) {
+	token, err := CreateJWT(user)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		w.Write(jsonMessageByte("Failed", "Internal server error"))
+		return
+	}
+	response := TokenResponse{"Success", token, token, refreshToken, "Bearer", int64(ACCESS_TOKEN_LIFETIME.Seconds())}
+	responseByte, _ := json.Marshal(response)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(responseByte)
+}
+
+// Handle refresh, the refresh token is exchanged for a new token pair
+// and can not be used again
+func RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		w.Write(jsonMessageByte("Failed", r.Method+" - Method not allowed"))
+		return
+	}
+	var request RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.RefreshToken == "" {
+		w.WriteHeader(400)
+		w.Write(jsonMessageByte("Failed", "Bad Request - body must contain refresh_token"))
+		return
+	}
+	refreshToken, userName, err := RefreshTokens.Rotate(request.RefreshToken)
+	var account Account
+	if err == nil {
+		// roles are read again, so changes apply from the next refresh
+		account, err = Users.Get(userName)
+		if err == ErrUserNotFound {
+			RefreshTokens.Revoke(refreshToken)
+			err = fmt.Errorf("%w: user %v does not exist", ErrInvalidRefreshToken, userName)
+		}
+	}
+	if errors.Is(err, ErrInvalidRefreshToken) {
+		log.Println(err)
+		w.WriteHeader(401)
+		w.Write(jsonMessageByte("Failed", "Invalid refresh token"))
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		w.Write(jsonMessageByte("Failed", "Internal server error"))
+		return
+	}
+	writeTokenPair(w, accountPrincipal(account), refreshToken)
+}
+
+// returned for unknown, expired and reused refresh tokens
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+// issued refresh token, stored by the hash of the token
+type refreshSession struct {
+	UserName string
+	// all the tokens rotated from one login share the family
+	Family  string
+	Expires time.Time
+	Used    bool
+}
+
+// opaque refresh tokens kept in memory
+// every token can be exchanged once. Presenting a used token again means
+// it was stolen, so the whole family of tokens from that login is revoked
+type RefreshTokenStore struct {
+	mu       sync.Mutex
+	lifetime time.Duration
+	sessions map[string]*refreshSession
+}
+
+// refresh tokens issued by LoginHandler
+var RefreshTokens = NewRefreshTokenStore(REFRESH_TOKEN_LIFETIME)
+
+// create store for tokens valid for lifetime
+func NewRefreshTokenStore(lifetime time.Duration) *RefreshTokenStore {
+	return &RefreshTokenStore{lifetime: lifetime, sessions: map[string]*refreshSession{}}
+}
+
+// Issue new refresh token for user, empty family starts a new one
+func (s *RefreshTokenStore) Issue(userName string, family string) (string, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+	if family == "" {
+		family = hashToken(token)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for hash, session := range s.sessions {
+		if now.After(session.Expires) {
+			delete(s.sessions, hash)
+		}
+	}
+	s.sessions[hashToken(token)] = &refreshSession{userName, family, now.Add(s.lifetime), false}
+	return token, nil
+}
+
+// Rotate exchanges token for a new one of the same user and family
+// and returns the user of the token
+func (s *RefreshTokenStore) Rotate(token string) (string, string, error) {
+	s.mu.Lock()
+	session, ok := s.sessions[hashToken(token)]
+	if !ok || time.Now().After(session.Expires) {
+		s.mu.Unlock()
+		return "", "", ErrInvalidRefreshToken
+	}
+	if session.Used {
+		s.revokeFamily(session.Family)
+		s.mu.Unlock()
+		return "", "", fmt.Errorf("%w: reused, revoked all tokens of %v", ErrInvalidRefreshToken, session.UserName)
+	}
+	session.Used = true
+	s.mu.Unlock()
+	token, err := s.Issue(session.UserName, session.Family)
+	return token, session.UserName, err
+}
+
+// Revoke all the tokens of the family of token, e.g. on logout
+func (s *RefreshTokenStore) Revoke(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.sessions[hashToken(token)]; ok {
+		s.revokeFamily(session.Family)
+	}
+}
+
+// RevokeUser revokes all the tokens of the user, e.g. after a password change
+func (s *RefreshTokenStore) RevokeUser(userName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, session := range s.sessions {
+		if session.UserName == userName {
+			delete(s.sessions, hash)
+		}
+	}
+}
+
+func (s *RefreshTokenStore) revokeFamily(family string) {
+	for hash, session := range s.sessions {
+		if session.Family == family {
+			delete(s.sessions, hash)
+		}
+	}
+}
+
+// tokens are stored hashed, so a leaked store does not leak usable tokens
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// list of tokens revoked before their expiry, keyed by jti
+// entries can be forgotten after expires, the token is rejected anyway then
+type RevocationStore interface {
+	Revoke(jti string, expires time.Time) error
+	IsRevoked(jti string) (bool, error)
+	Revoked() ([]Revocation, error)
+}
+
+// revoked tokens consulted by ValidateJWT, in memory unless JWT_REVOCATION_FILE is set
+var Revocations RevocationStore = NewMemoryRevocationStore()
+
+// random token id
+func newTokenID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return base64.RawURLEncoding.EncodeToString(id)
+}
+
+// true when the token is revoked, errors of the store count as revoked
+func tokenRevoked(claims *MyCustomClaims) bool {
+	if claims.ID == "" {
+		return false
+	}
+	revoked, err := Revocations.IsRevoked(claims.ID)
+	if err != nil {
+		log.Println(err)
+		return true
+	}
+	return revoked
+}
+
+// revocation list in memory, expired entries are evicted
+type MemoryRevocationStore struct {
+	mu      sync.Mutex
+	revoked map[string]time.Time
+	// next time expired entries are looked for
+	nextEviction time.Time
+}
+
+// create empty revocation list
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{revoked: map[string]time.Time{}}
+}
+
+// Revoke token until it expires
+func (s *MemoryRevocationStore) Revoke(jti string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict()
+	s.revoked[jti] = expires
+	return nil
+}
+
+// IsRevoked checks the list, expired entries are not revoked anymore
+func (s *MemoryRevocationStore) IsRevoked(jti string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict()
+	expires, ok := s.revoked[jti]
+	return ok && time.Now().Before(expires), nil
+}
+
+// Revoked lists the tokens which are revoked and not expired yet
+func (s *MemoryRevocationStore) Revoked() ([]Revocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	revoked := []Revocation{}
+	for jti, expires := range s.revoked {
+		if now.Before(expires) {
+			revoked = append(revoked, Revocation{jti, expires.UTC()})
+		}
+	}
+	sort.Slice(revoked, func(i, j int) bool { return revoked[i].ID < revoked[j].ID })
+	return revoked, nil
+}
+
+// remove expired entries at most once a minute
+func (s *MemoryRevocationStore) evict() {
+	now := time.Now()
+	if now.Before(s.nextEviction) {
+		return
+	}
+	for jti, expires := range s.revoked {
+		if !now.Before(expires) {
+			delete(s.revoked, jti)
+		}
+	}
+	s.nextEviction = now.Add(time.Minute)
+}
+
+// entry of the revocation file and of the list served at /revocations
+type Revocation struct {
+	ID      string    `json:"jti"`
+	Expires time.Time `json:"exp"`
+}
+
+// revocation list which survives restarts
+// revocations are appended to a file, one json entry per line, and kept in memory.
+// The file is rewritten without the expired entries when it is opened
+type FileRevocationStore struct {
+	mu     sync.Mutex
+	path   string
+	memory *MemoryRevocationStore
+}
+
+// open revocation file, it is created when missing
+func NewFileRevocationStore(path string) (*FileRevocationStore, error) {
+	s := &FileRevocationStore{path: path, memory: NewMemoryRevocationStore()}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var kept bytes.Buffer
+	now := time.Now()
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var entry Revocation
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, i+1, err)
+		}
+		if now.Before(entry.Expires) {
+			s.memory.Revoke(entry.ID, entry.Expires)
+			kept.Write(line)
+			kept.WriteByte('\n')
+		}
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, kept.Bytes(), 0600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Revoke token and append it to the file
+func (s *FileRevocationStore) Revoke(jti string, expires time.Time) error {
+	line, err := json.Marshal(Revocation{jti, expires.UTC()})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return s.memory.Revoke(jti, expires)
+}
+
+// IsRevoked checks the entries read from the file
+func (s *FileRevocationStore) IsRevoked(jti string) (bool, error) {
+	return s.memory.IsRevoked(jti)
+}
+
+// Revoked lists the entries read from the file which are not expired yet
+func (s *FileRevocationStore) Revoked() ([]Revocation, error) {
+	return s.memory.Revoked()
+}
+
+// tokens revoked before their expiry, served at /revocations
+type RevocationList struct {
+	Revoked []Revocation `json:"revoked"`
+}
+
+// Handle /revocations, services verifying our tokens with the JWKS
+// poll it to reject tokens revoked by logout
+func RevocationListHandler(w http.ResponseWriter, r *http.Request) {
+	revoked, err := Revocations.Revoked()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		w.Write(jsonMessageByte("Failed", "Internal server error"))
+		return
+	}
+	listByte, _ := json.Marshal(RevocationList{revoked})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(listByte)
+}
+
+// body of /logout, refresh_token is optional
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Handle logout, revokes the token of the request
+// with a refresh token in the body the refresh tokens of the login are revoked too
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		w.Write(jsonMessageByte("Failed", r.Method+" - Method not allowed"))
+		return
+	}
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok || claims.ID == "" || claims.ExpiresAt == nil {
+		w.WriteHeader(400)
+		w.Write(jsonMessageByte("Failed", "Token can not be revoked"))
+		return
+	}
+	if err := Revocations.Revoke(claims.ID, claims.ExpiresAt.Time); err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		w.Write(jsonMessageByte("Failed", "Internal server error"))
+		return
+	}
+
+	var request LogoutRequest
+	if json.NewDecoder(r.Body).Decode(&request) == nil && request.RefreshToken != "" {
+		RefreshTokens.Revoke(request.RefreshToken)
+	}
+	w.Write(jsonMessageByte("Success", "Logged out"))
+}
+
+// returned by the user store
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user already exists")
+)
+
+// user known to the service, only the bcrypt hash of the password is kept
+type Account struct {
+	UserName     string    `json:"username"`
+	PasswordHash string    `json:"password_hash"`
+	Roles        []string  `json:"roles,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// accounts which can log in
+type UserStore interface {
+	Get(userName string) (Account, error)
+	Create(account Account) error
+	Update(account Account) error
+}
+
+// users checked by LoginHandler, in memory unless JWT_USERS_FILE is set
+var Users UserStore = NewMemoryUserStore()
+
+// limits of user names and passwords
+const (
+	MIN_PASSWORD_LENGTH = 8
+	// bcrypt uses only the first 72 bytes
+	MAX_PASSWORD_LENGTH = 72
+	MAX_USERNAME_LENGTH = 64
+)
+
+// hash of a random password, compared when the user does not exist,
+// so unknown and known user names take the same time
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// create admin user with password JWT_ADMIN_PASSWORD when it is missing
+// without JWT_ADMIN_PASSWORD there is no admin until the service is started with it
+func bootstrapAdmin(users UserStore) error {
+	if _, err := users.Get("admin"); err != ErrUserNotFound {
+		return err
+	}
+	password, ok := os.LookupEnv("JWT_ADMIN_PASSWORD")
+	if !ok {
+		log.Println("No user admin, set JWT_ADMIN_PASSWORD to create it")
+		return nil
+	}
+	if reason := checkPassword(password); reason != "" {
+		return errors.New("JWT_ADMIN_PASSWORD: " + reason)
+	}
+	account, err := newAccount("admin", password, "admin")
+	if err != nil {
+		return err
+	}
+	return users.Create(account)
+}
+
+// account with hashed password
+func newAccount(userName string, password string, roles ...string) (Account, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return Account{}, err
+	}
+	return Account{userName, string(hash), roles, time.Now().UTC()}, nil
+}
+
+// account of the user when the user exists and the password matches
+func authenticate(userName string, password string) (Account, bool) {
+	account, err := Users.Get(userName)
+	if err != nil {
+		if err != ErrUserNotFound {
+			log.Println(err)
+		}
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return Account{}, false
+	}
+	return account, bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(password)) == nil
+}
+
+// reason why the user name can not be registered, empty when it can
+func checkUserName(userName string) string {
+	if userName == "" || len(userName) > MAX_USERNAME_LENGTH {
+		return fmt.Sprintf("User name must have 1 to %d characters", MAX_USERNAME_LENGTH)
+	}
+	for _, c := range userName {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return "User name may only contain letters, digits, '.', '_' and '-'"
+		}
+	}
+	return ""
+}
+
+// reason why the password can not be used, empty when it can
+func checkPassword(password string) string {
+	if len(password) < MIN_PASSWORD_LENGTH || len(password) > MAX_PASSWORD_LENGTH {
+		return fmt.Sprintf("Password must have %d to %d characters", MIN_PASSWORD_LENGTH, MAX_PASSWORD_LENGTH)
+	}
+	return ""
+}
+
+// users kept in memory
+type MemoryUserStore struct {
+	mu       sync.RWMutex
+	accounts map[string]Account
+}
+
+// create empty user store
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{accounts: map[string]Account{}}
+}
+
+// Get user by name
+func (s *MemoryUserStore) Get(userName string) (Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	account, ok := s.accounts[userName]
+	if !ok {
+		return Account{}, ErrUserNotFound
+	}
+	return account, nil
+}
+
+// Create new user
+func (s *MemoryUserStore) Create(account Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.accounts[account.UserName]; ok {
+		return ErrUserExists
+	}
+	s.accounts[account.UserName] = account
+	return nil
+}
+
+// Update existing user
+func (s *MemoryUserStore) Update(account Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.accounts[account.UserName]; !ok {
+		return ErrUserNotFound
+	}
+	s.accounts[account.UserName] = account
+	return nil
+}
+
+// remove user, used to roll back a Create
+func (s *MemoryUserStore) remove(userName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.accounts, userName)
+}
+
+// users kept in a json file, it is rewritten on every change
+type FileUserStore struct {
+	mu     sync.Mutex
+	path   string
+	memory *MemoryUserStore
+}
+
+// open users file, it is created by the first change
+func NewFileUserStore(path string) (*FileUserStore, error) {
+	s := &FileUserStore{path: path, memory: NewMemoryUserStore()}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var accounts []Account
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, account := range accounts {
+		s.memory.accounts[account.UserName] = account
+	}
+	return s, nil
+}
+
+// Get user by name
+func (s *FileUserStore) Get(userName string) (Account, error) {
+	return s.memory.Get(userName)
+}
+
+// Create new user and save the file
+func (s *FileUserStore) Create(account Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.memory.Create(account); err != nil {
+		return err
+	}
+	if err := s.save(); err != nil {
+		s.memory.remove(account.UserName)
+		return err
+	}
+	return nil
+}
+
+// Update existing user and save the file
+func (s *FileUserStore) Update(account Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, err := s.memory.Get(account.UserName)
+	if err != nil {
+		return err
+	}
+	s.memory.Update(account)
+	if err := s.save(); err != nil {
+		s.memory.Update(previous)
+		return err
+	}
+	return nil
+}
+
+// write all the users through a temp file, readable only by the owner
+func (s *FileUserStore) save() error {
+	s.memory.mu.RLock()
+	accounts := make([]Account, 0, len(s.memory.accounts))
+	for _, account := range s.memory.accounts {
+		accounts = append(accounts, account)
+	}
+	s.memory.mu.RUnlock()
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].UserName < accounts[j].UserName })
+
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// body of /password
+type PasswordChange struct {
+	UserName    string `json:"username"`
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+// Handle registration of a new user
+func RegisterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		w.Write(jsonMessageByte("Failed", r.Method+" - Method not allowed"))
+		return
+	}
+	var userData User
+	if err := json.NewDecoder(r.Body).Decode(&userData); err != nil {
+		w.WriteHeader(400)
+		w.Write(jsonMessageByte("Failed", "Bad Request - Failed to parse the payload "))
+		return
+	}
+	reason := checkUserName(userData.UserName)
+	if reason == "" {
+		reason = checkPassword(userData.Password)
+	}
+	if reason != "" {
+		w.WriteHeader(422)
+		w.Write(jsonMessageByte("Failed", reason))
+		return
+	}
+
+	account, err := newAccount(userData.UserName, userData.Password, "user")
+	if err == nil {
+		err = Users.Create(account)
+	}
+	if err == ErrUserExists {
+		w.WriteHeader(409)
+		w.Write(jsonMessageByte("Failed", "User already exists"))
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		w.Write(jsonMessageByte("Failed", "Internal server error"))
+	} else {
+		w.WriteHeader(201)
+		w.Write(jsonMessageByte("Success", "User registered"))
+	}
+}
+
+// Handle password change, the old password must be given
+func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		w.Write(jsonMessageByte("Failed", r.Method+" - Method not allowed"))
+		return
+	}
+	var change PasswordChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		w.WriteHeader(400)
+		w.Write(jsonMessageByte("Failed", "Bad Request - Failed to parse the payload "))
+		return
+	}
+	account, ok := authenticate(change.UserName, change.OldPassword)
+	if !ok {
+		w.WriteHeader(401)
+		w.Write(jsonMessageByte("Failed", "Invalid credentials"))
+		return
+	}
+	if reason := checkPassword(change.NewPassword); reason != "" {
+		w.WriteHeader(422)
+		w.Write(jsonMessageByte("Failed", reason))
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(change.NewPassword), bcrypt.DefaultCost)
+	if err == nil {
+		account.PasswordHash = string(hash)
+		err = Users.Update(account)
+	}
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		w.Write(jsonMessageByte("Failed", "Internal server error"))
+		return
+	}
+	// sessions started with the old password must log in again
+	RefreshTokens.RevokeUser(account.UserName)
+	w.Write(jsonMessageByte("Success", "Password changed"))
+}
+
+// body of /roles
+type RolesChange struct {
+	UserName string   `json:"username"`
+	Roles    []string `json:"roles"`
+}
+
+// Handle change of the roles of a user, they apply to the next token of the user
+func SetRolesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		w.Write(jsonMessageByte("Failed", r.Method+" - Method not allowed"))
+		return
+	}
+	var change RolesChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		w.WriteHeader(400)
+		w.Write(jsonMessageByte("Failed", "Bad Request - Failed to parse the payload "))
+		return
+	}
+	for _, role := range change.Roles {
+		if _, ok := ROLE_SCOPES[role]; !ok {
+			w.WriteHeader(422)
+			w.Write(jsonMessageByte("Failed", "Unknown role "+role))
+			return
+		}
+	}
+
+	account, err := Users.Get(change.UserName)
+	if err == nil {
+		account.Roles = change.Roles
+		err = Users.Update(account)
+	}
+	if err == ErrUserNotFound {
+		w.WriteHeader(404)
+		w.Write(jsonMessageByte("Failed", "User not found"))
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		w.Write(jsonMessageByte("Failed", "Internal server error"))
+	} else {
+		w.Write(jsonMessageByte("Success", "Roles changed"))
+	}
+}
+
 // Handle home route
 func HomeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonMessageByte("Success", "Welcome to Golang with JWT authentication"))
@@ -132,5 +1880,26 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 
 // Handle secure route
 func SecureHandler(w http.ResponseWriter, r *http.Request) {
-	w.Write(jsonMessageByte("Success", "Congrats and Welcome to the Secure page!. You gave me the correct JWT token!"))
+	userName := "anonymous"
+	if claims, ok := ClaimsFromContext(r.Context()); ok {
+		userName = claims.Subject
+	}
+	w.Write(jsonMessageByte("Success", "Congrats "+userName+" and Welcome to the Secure page!. You gave me the correct JWT token!"))
+}
+
+// register all the routes of the service
+func NewServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", HomeHandler)
+	mux.HandleFunc("/login", LoginHandler)
+	mux.HandleFunc("/refresh", RefreshHandler)
+	mux.HandleFunc("/logout", Auth(LogoutHandler))
+	mux.HandleFunc("/register", RegisterHandler)
+	mux.HandleFunc("/password", ChangePasswordHandler)
+	mux.HandleFunc("/roles", Authorize(Policy{Roles: []string{"admin"}, Scopes: []string{"users:write"}}, SetRolesHandler))
+	mux.HandleFunc("/secure", Auth(SecureHandler))
+	mux.HandleFunc("/.well-known/jwks.json", JWKSHandler)
+	mux.HandleFunc("/.well-known/openid-configuration", DiscoveryHandler)
+	mux.HandleFunc("/revocations", RevocationListHandler)
+	return mux
 }
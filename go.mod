@@ -5,7 +5,7 @@ go 1.16
 require (
 	github.com/go-playground/validator/v10 v10.16.0
 	github.com/gorilla/mux v1.8.0
-	github.com/golang-jwt/jwt/v4 v4.5.2 // indirect
+	github.com/golang-jwt/jwt/v4 v4.5.2
 	github.com/jmoiron/sqlx v1.3.5
 	github.com/joho/godotenv v1.5.1
 	github.com/lib/pq v1.10.9
@@ -19,6 +19,9 @@ require (
 	go.opentelemetry.io/otel/exporters/otlp/otlptrace v1.21.0
 	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc v1.21.0
 	go.opentelemetry.io/otel/sdk v1.21.0
+	golang.org/x/crypto v0.16.0
 	golang.org/x/sync v0.5.0
+	golang.org/x/text v0.14.0
 	google.golang.org/grpc v1.59.0
+	modernc.org/sqlite v1.28.0
 )